@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// CharClass groups the characters maskValue knows how to substitute. Each
+// character is replaced by a random character of the same class (and case), or
+// kept as is when its class is preserved.
+type CharClass string
+
+const (
+	ClassLower    CharClass = "lower"     // ASCII a-z
+	ClassUpper    CharClass = "upper"     // ASCII A-Z
+	ClassDigit    CharClass = "digit"     // ASCII 0-9
+	ClassLatinExt CharClass = "latin_ext" // accented and extended Latin letters (ü, ó, ß, ...)
+	ClassCyrillic CharClass = "cyrillic"
+	ClassGreek    CharClass = "greek"
+	ClassArabic   CharClass = "arabic"
+	ClassCJK      CharClass = "cjk" // Han, Hiragana, Katakana and Hangul
+)
+
+var allCharClasses = []CharClass{
+	ClassLower, ClassUpper, ClassDigit, ClassLatinExt,
+	ClassCyrillic, ClassGreek, ClassArabic, ClassCJK,
+}
+
+// scriptAlphabet holds the replacement pools for the letters of one script.
+// Letters are only ever replaced by letters of the same script and case.
+type scriptAlphabet struct {
+	class  CharClass
+	script *unicode.RangeTable
+	upper  []rune
+	lower  []rune
+	other  []rune // uncased letters (Arabic, CJK, ...)
+}
+
+var (
+	asciiLower = runeRange('a', 'z')
+	asciiUpper = runeRange('A', 'Z')
+	asciiDigit = runeRange('0', '9')
+
+	// The pools are drawn from fixed, fully assigned blocks so keyed masking
+	// stays reproducible across Go/Unicode versions
+	scriptAlphabets = []*scriptAlphabet{
+		newScriptAlphabet(ClassLatinExt, unicode.Latin, [][2]rune{{0x00C0, 0x024F}}),
+		newScriptAlphabet(ClassCyrillic, unicode.Cyrillic, [][2]rune{{0x0410, 0x044F}}),
+		newScriptAlphabet(ClassGreek, unicode.Greek, [][2]rune{{0x0391, 0x03A9}, {0x03B1, 0x03C9}}),
+		newScriptAlphabet(ClassArabic, unicode.Arabic, [][2]rune{{0x0621, 0x064A}}),
+		newScriptAlphabet(ClassCJK, unicode.Han, [][2]rune{{0x4E00, 0x9FA5}}),
+		newScriptAlphabet(ClassCJK, unicode.Hiragana, [][2]rune{{0x3041, 0x3096}}),
+		newScriptAlphabet(ClassCJK, unicode.Katakana, [][2]rune{{0x30A1, 0x30FA}}),
+		newScriptAlphabet(ClassCJK, unicode.Hangul, [][2]rune{{0xAC00, 0xD7A3}}),
+	}
+)
+
+func runeRange(lo, hi rune) []rune {
+	out := make([]rune, 0, hi-lo+1)
+	for r := lo; r <= hi; r++ {
+		out = append(out, r)
+	}
+	return out
+}
+
+func newScriptAlphabet(class CharClass, script *unicode.RangeTable, ranges [][2]rune) *scriptAlphabet {
+	sa := &scriptAlphabet{class: class, script: script}
+	for _, rg := range ranges {
+		for r := rg[0]; r <= rg[1]; r++ {
+			if !unicode.IsLetter(r) || !unicode.Is(script, r) {
+				continue
+			}
+			switch {
+			case unicode.IsUpper(r):
+				sa.upper = append(sa.upper, r)
+			case unicode.IsLower(r):
+				sa.lower = append(sa.lower, r)
+			default:
+				sa.other = append(sa.other, r)
+			}
+		}
+	}
+	return sa
+}
+
+// classifyRune returns the class of ch and the pool its replacement is drawn
+// from. ok is false for characters that are never substituted (punctuation,
+// whitespace, symbols, letters of unsupported scripts).
+func classifyRune(ch rune) (class CharClass, pool []rune, ok bool) {
+	switch {
+	case ch >= 'a' && ch <= 'z':
+		return ClassLower, asciiLower, true
+	case ch >= 'A' && ch <= 'Z':
+		return ClassUpper, asciiUpper, true
+	case ch >= '0' && ch <= '9':
+		return ClassDigit, asciiDigit, true
+	case ch < 0x80 || !unicode.IsLetter(ch):
+		return "", nil, false
+	}
+
+	for _, sa := range scriptAlphabets {
+		if !unicode.Is(sa.script, ch) {
+			continue
+		}
+
+		switch {
+		case unicode.IsUpper(ch) && len(sa.upper) > 0:
+			return sa.class, sa.upper, true
+		case unicode.IsLower(ch) && len(sa.lower) > 0:
+			return sa.class, sa.lower, true
+		case len(sa.other) > 0:
+			return sa.class, sa.other, true
+		}
+		return "", nil, false
+	}
+
+	return "", nil, false
+}
+
+// parseCharClasses parses a comma-separated list of class names
+func parseCharClasses(classStr string) (map[CharClass]bool, error) {
+	classes := make(map[CharClass]bool)
+	for _, part := range strings.Split(classStr, ",") {
+		part = strings.ToLower(strings.TrimSpace(part))
+		if part == "" {
+			continue
+		}
+
+		class := CharClass(part)
+		if !isCharClass(class) {
+			return nil, fmt.Errorf("unknown character class '%s' (expected one of %s)", part, strings.Join(charClassNames(), ", "))
+		}
+		classes[class] = true
+	}
+	return classes, nil
+}
+
+func isCharClass(class CharClass) bool {
+	for _, c := range allCharClasses {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+func charClassNames() []string {
+	names := make([]string, 0, len(allCharClasses))
+	for _, c := range allCharClasses {
+		names = append(names, string(c))
+	}
+	sort.Strings(names)
+	return names
+}
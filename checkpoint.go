@@ -0,0 +1,538 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Checkpoint records how far a run got. RowsWritten is the number of input
+// rows fully written to the output, so the next row to process is at that
+// zero-based offset; OutputBytes is the output size at that point.
+type Checkpoint struct {
+	Status string `json:"status"` // running or interrupted
+
+	InputPath        string    `json:"input_path"`
+	InputSize        int64     `json:"input_size"`
+	InputModTime     time.Time `json:"input_mod_time"`
+	InputFingerprint string    `json:"input_fingerprint"`
+
+	OutputPath   string `json:"output_path"`
+	OutputFormat string `json:"output_format"`
+	PartialPath  string `json:"partial_path,omitempty"` // temporary file of a run that did not finish
+	OutputBytes  int64  `json:"output_bytes"`
+
+	RowsWritten    int64 `json:"rows_written"`
+	BatchesWritten int64 `json:"batches_written"`
+
+	// StatePath holds the substitutions of random maskers, sealed, so values
+	// seen before the checkpoint mask the same way after it; StateBytes is
+	// its length as of the checkpoint
+	StatePath  string `json:"state_path,omitempty"`
+	StateBytes int64  `json:"state_bytes,omitempty"`
+
+	// MaskingFingerprint identifies the policy or masking flags, the masked
+	// columns and the keys; a resume with other settings is refused
+	MaskingFingerprint string `json:"masking_fingerprint"`
+
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// checkpointPath places the checkpoint next to the output it describes
+func checkpointPath(outputPath string) string {
+	return outputPath + ".checkpoint.json"
+}
+
+// fingerprintBytes is how much of the input is hashed to identify it
+const fingerprintBytes = 1 << 20
+
+// inputIdentity describes the input file well enough to notice that it was
+// replaced between a run and its resume
+type inputIdentity struct {
+	size        int64
+	modTime     time.Time
+	fingerprint string // SHA-256 of the first fingerprintBytes
+}
+
+func readInputIdentity(path string) (*inputIdentity, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	if _, err := io.CopyN(h, file, fingerprintBytes); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to fingerprint %s: %w", path, err)
+	}
+
+	return &inputIdentity{
+		size:        info.Size(),
+		modTime:     info.ModTime().UTC(),
+		fingerprint: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+// loadCheckpoint reads the checkpoint for outputPath and checks that it
+// belongs to the same input and output format
+func loadCheckpoint(outputPath, inputPath, format string) (*Checkpoint, error) {
+	cpPath := checkpointPath(outputPath)
+	data, err := os.ReadFile(cpPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("no checkpoint found at %s", cpPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint %s: %w", cpPath, err)
+	}
+
+	var cp Checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint %s: %w", cpPath, err)
+	}
+
+	identity, err := readInputIdentity(inputPath)
+	if err != nil {
+		return nil, err
+	}
+	if identity.size != cp.InputSize || identity.fingerprint != cp.InputFingerprint {
+		return nil, fmt.Errorf("input %s does not match checkpoint %s (was %s, %d bytes)", inputPath, cpPath, cp.InputPath, cp.InputSize)
+	}
+
+	if cp.OutputFormat != format {
+		return nil, fmt.Errorf("checkpoint %s is for %s output, not %s", cpPath, cp.OutputFormat, format)
+	}
+
+	return &cp, nil
+}
+
+// checkMasking refuses to resume a run that masked with other settings,
+// which would mask the rest of the input differently
+func (cp *Checkpoint) checkMasking(fingerprint string) error {
+	if cp.MaskingFingerprint != fingerprint {
+		return fmt.Errorf("checkpoint %s was written with other masking settings (policy, columns or keys); resume with the same ones or start over without -resume", checkpointPath(cp.OutputPath))
+	}
+	return nil
+}
+
+// resumeFrom picks the file holding the output written so far: the temporary
+// file of the run that stopped, or the output itself for checkpoints that
+// don't name one
+func (cp *Checkpoint) resumeFrom() (string, error) {
+	path := cp.PartialPath
+	if path == "" {
+		path = cp.OutputPath
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("output recorded in checkpoint is gone: %w", err)
+	}
+	if info.Size() < cp.OutputBytes {
+		return "", fmt.Errorf("output %s is shorter (%d bytes) than the checkpoint records (%d bytes)", path, info.Size(), cp.OutputBytes)
+	}
+	return path, nil
+}
+
+// writeCheckpoint replaces the checkpoint file atomically, so a crash while
+// writing never leaves a truncated checkpoint
+func writeCheckpoint(path string, cp *Checkpoint) error {
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode checkpoint: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create checkpoint file: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // no-op after a successful rename
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync checkpoint: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close checkpoint: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to move checkpoint into place: %w", err)
+	}
+	return nil
+}
+
+// statefulMasker is implemented by maskers whose output depends on what they
+// have already seen (random or unique substitution). A checkpoint stores
+// their Changes and a resumed run Restores them.
+type statefulMasker interface {
+	// Stateful reports whether the masker has state to checkpoint at all
+	Stateful() bool
+
+	// TrackChanges starts recording state for Changes; it is called before
+	// masking starts, and only for runs that checkpoint
+	TrackChanges()
+
+	// Changes returns the state added since the last call
+	Changes() map[string]string
+
+	Restore(state map[string]string) error
+}
+
+// stateJournal collects state added between two checkpoints; a nil journal
+// records nothing
+type stateJournal struct {
+	mu      sync.Mutex
+	entries map[string]string
+}
+
+func newStateJournal() *stateJournal {
+	return &stateJournal{entries: make(map[string]string)}
+}
+
+func (j *stateJournal) add(key, value string) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	j.entries[key] = value
+	j.mu.Unlock()
+}
+
+// take returns the entries collected so far and starts over
+func (j *stateJournal) take() map[string]string {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entries := j.entries
+	j.entries = make(map[string]string)
+	return entries
+}
+
+// stateAAD binds sealed state records to their purpose
+var stateAAD = []byte("go_masking checkpoint state")
+
+// statefulMaskers returns each stateful masker of columns once, with the path
+// of the first column it masks
+func statefulMaskers(columns []ColumnMasker, schema *Schema) map[string]statefulMasker {
+	maskers := make(map[string]statefulMasker)
+	seen := make(map[statefulMasker]bool)
+	for _, col := range columns {
+		sm, ok := col.Masker.(statefulMasker)
+		if !ok || !sm.Stateful() || seen[sm] {
+			continue
+		}
+		seen[sm] = true
+		maskers[schema.Columns[col.Index].Path] = sm
+	}
+	return maskers
+}
+
+// maskingFingerprint identifies what a run masks and how: the policy file or
+// the masking flags, the masked columns and, through an HMAC, the keys
+func maskingFingerprint(config *AppConfig, columns []ColumnMasker, schema *Schema) (string, error) {
+	h := sha256.New()
+	if config.PolicyPath != "" {
+		policy, err := os.ReadFile(config.PolicyPath)
+		if err != nil {
+			return "", fmt.Errorf("failed to read policy %s: %w", config.PolicyPath, err)
+		}
+		h.Write(policy)
+	} else {
+		preserve := make([]string, 0, len(config.Preserve))
+		for class := range config.Preserve {
+			preserve = append(preserve, string(class))
+		}
+		sort.Strings(preserve)
+		fmt.Fprintf(h, "fpe=%s alphabet=%s tweak=%x preserve=%v unique=%t domain=%s\n",
+			config.FPEMode, config.FPEAlphabet, config.FPETweak, preserve, config.Unique, config.VaultDomain)
+	}
+
+	for _, col := range columns {
+		fmt.Fprintf(h, "%s %T keep_nulls=%t\n", schema.Columns[col.Index].Path, col.Masker, col.KeepNulls)
+	}
+	for _, key := range [][]byte{config.MaskKey, config.VaultKey} {
+		if key != nil {
+			h.Write(deriveKey(key, "go_masking checkpoint key check"))
+		}
+	}
+	fmt.Fprintf(h, "vault=%s\n", config.VaultPath)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checkpointStateKey is the key masking state is sealed with: derived from the
+// masking key, or else the vault key; nil without either
+func checkpointStateKey(config *AppConfig) []byte {
+	switch {
+	case config.MaskKey != nil:
+		return deriveKey(config.MaskKey, "go_masking checkpoint state key")
+	case config.VaultKey != nil:
+		return deriveKey(config.VaultKey, "go_masking checkpoint state key")
+	}
+	return nil
+}
+
+// newCheckpointer prepares the checkpoints of a run and, when it resumes,
+// restores the masking state of the checkpoint. The state of random maskers
+// is only stored sealed with a key; without one it returns nil, so the run
+// can't be checkpointed, or an error if checkpoints were asked for.
+func newCheckpointer(config *AppConfig, identity *inputIdentity, sink ResumableSink, schema *Schema, columns []ColumnMasker, vault *tokenVault, resumed *Checkpoint) (*checkpointer, error) {
+	fingerprint, err := maskingFingerprint(config, columns, schema)
+	if err != nil {
+		return nil, err
+	}
+	if config.Resume {
+		if err := resumed.checkMasking(fingerprint); err != nil {
+			return nil, err
+		}
+	}
+
+	c := &checkpointer{
+		path:        checkpointPath(config.OutputFile),
+		config:      config,
+		identity:    identity,
+		sink:        sink,
+		schema:      schema,
+		columns:     columns,
+		every:       config.CheckpointEvery,
+		baseRows:    resumed.RowsWritten,
+		baseBatches: resumed.BatchesWritten,
+		fingerprint: fingerprint,
+		vault:       vault,
+		stateful:    statefulMaskers(columns, schema),
+	}
+
+	if len(c.stateful) > 0 {
+		key := checkpointStateKey(config)
+		if key == nil {
+			if config.Resume || config.CheckpointEvery > 0 {
+				return nil, errors.New("random or unique masking without -mask_key or -vault can't be checkpointed, as its substitutions would be stored unencrypted; add a key or drop -checkpoint_every and -resume")
+			}
+			logger.Warn("Random or unique masking without a key can't be checkpointed; an interrupted run discards its output")
+			return nil, nil
+		}
+		if c.state, err = newSealer(key); err != nil {
+			return nil, err
+		}
+		for _, sm := range c.stateful {
+			sm.TrackChanges()
+		}
+	}
+
+	if config.Resume {
+		if err := c.restoreState(resumed.StatePath, resumed.StateBytes); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// checkpointer writes checkpoints for one run. baseRows and baseBatches are
+// the progress of the run being resumed, if any.
+type checkpointer struct {
+	path        string
+	config      *AppConfig
+	identity    *inputIdentity
+	sink        ResumableSink
+	schema      *Schema
+	columns     []ColumnMasker
+	every       int // batches between periodic checkpoints; 0 disables them
+	baseRows    int64
+	baseBatches int64
+	saved       int // periodic checkpoints written by this run
+	fingerprint string
+	vault       *tokenVault // flushed with every checkpoint; nil without -vault
+
+	stateful   map[string]statefulMasker // by column path
+	state      *sealer                   // seals their changes; nil if there are none
+	statePath  string                    // created on the first save unless resumed
+	stateBytes int64                     // length of the state file
+	ownsState  bool                      // statePath was created by this run
+}
+
+// Save records progress after rows and batches of this run have been flushed
+func (c *checkpointer) Save(status string, rows, batches int) error {
+	partialPath, size, err := c.sink.Position()
+	if err != nil {
+		return fmt.Errorf("failed to read output position: %w", err)
+	}
+	if partialPath == c.config.OutputFile {
+		partialPath = "" // already closed into place
+	}
+
+	// Tokens in the output must be in the vault before the checkpoint
+	// counts them as written
+	if err := c.vault.Flush(); err != nil {
+		return fmt.Errorf("failed to write to vault: %w", err)
+	}
+	if err := c.saveState(); err != nil {
+		return err
+	}
+
+	cp := &Checkpoint{
+		Status:             status,
+		InputPath:          c.config.InputPath,
+		InputSize:          c.identity.size,
+		InputModTime:       c.identity.modTime,
+		InputFingerprint:   c.identity.fingerprint,
+		OutputPath:         c.config.OutputFile,
+		OutputFormat:       c.config.OutputFormat,
+		PartialPath:        partialPath,
+		OutputBytes:        size,
+		RowsWritten:        c.baseRows + int64(rows),
+		BatchesWritten:     c.baseBatches + int64(batches),
+		StatePath:          c.statePath,
+		StateBytes:         c.stateBytes,
+		MaskingFingerprint: c.fingerprint,
+		UpdatedAt:          time.Now().UTC(),
+	}
+	if err := writeCheckpoint(c.path, cp); err != nil {
+		return err
+	}
+
+	if status == "running" {
+		c.saved++
+	}
+	return nil
+}
+
+// saveState appends the changes of the stateful maskers to the state file as
+// one sealed record: a 4-byte length and the sealed JSON. Only what changed
+// since the last call is written, so the cost follows the new values rather
+// than all values seen. It runs with every checkpoint and output flush, so
+// changes don't pile up in memory between checkpoints.
+func (c *checkpointer) saveState() error {
+	if c.state == nil {
+		return nil
+	}
+
+	changes := make(map[string]map[string]string)
+	for path, sm := range c.stateful {
+		if entries := sm.Changes(); len(entries) > 0 {
+			changes[path] = entries
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+
+	plain, err := json.Marshal(changes)
+	if err != nil {
+		return fmt.Errorf("failed to encode masking state: %w", err)
+	}
+	sealed, err := c.state.seal(plain, stateAAD)
+	if err != nil {
+		return fmt.Errorf("failed to seal masking state: %w", err)
+	}
+	record := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(sealed)), uint32(len(sealed)))
+	record = append(record, sealed...)
+
+	if c.statePath == "" {
+		file, err := os.CreateTemp(filepath.Dir(c.config.OutputFile), "."+filepath.Base(c.config.OutputFile)+".*.state")
+		if err != nil {
+			return fmt.Errorf("failed to create masking state file: %w", err)
+		}
+		file.Close()
+		c.statePath, c.ownsState = file.Name(), true
+	}
+
+	path := c.statePath
+	file, err := os.OpenFile(path, os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open masking state %s: %w", path, err)
+	}
+	// Anything past the last checkpoint belongs to no checkpoint
+	if _, err := file.WriteAt(record, c.stateBytes); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write masking state %s: %w", path, err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync masking state %s: %w", path, err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close masking state %s: %w", path, err)
+	}
+
+	c.stateBytes += int64(len(record))
+	return nil
+}
+
+// restoreState gives the stateful maskers back the state recorded up to the
+// resumed checkpoint; later saves append to the same file
+func (c *checkpointer) restoreState(path string, size int64) error {
+	if size == 0 {
+		return nil
+	}
+	if c.state == nil {
+		return errors.New("checkpoint has masking state but the run has no masker to restore it to")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open masking state: %w", err)
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(io.LimitReader(file, size))
+	var read int64
+	for read < size {
+		var length [4]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return fmt.Errorf("masking state %s is shorter than the checkpoint records: %w", path, err)
+		}
+		sealed := make([]byte, binary.BigEndian.Uint32(length[:]))
+		if _, err := io.ReadFull(r, sealed); err != nil {
+			return fmt.Errorf("masking state %s is shorter than the checkpoint records: %w", path, err)
+		}
+		read += int64(len(length) + len(sealed))
+
+		plain, err := c.state.open(sealed, stateAAD)
+		if err != nil {
+			return fmt.Errorf("masking state %s can't be decrypted with this key: %w", path, err)
+		}
+		var changes map[string]map[string]string
+		if err := json.Unmarshal(plain, &changes); err != nil {
+			return fmt.Errorf("invalid masking state %s: %w", path, err)
+		}
+		for columnPath, entries := range changes {
+			sm, ok := c.stateful[columnPath]
+			if !ok {
+				return fmt.Errorf("masking state %s is for column '%s', which this run masks without state", path, columnPath)
+			}
+			if err := sm.Restore(entries); err != nil {
+				return err
+			}
+		}
+	}
+
+	c.statePath, c.stateBytes = path, size
+	return nil
+}
+
+// removeState deletes the state file once no checkpoint needs it
+func (c *checkpointer) removeState() {
+	if c != nil && c.statePath != "" {
+		os.Remove(c.statePath)
+	}
+}
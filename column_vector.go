@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/xitongsys/parquet-go/parquet"
+)
+
+// vectorKind is the Go type a ColumnVector holds its values as
+type vectorKind int
+
+const (
+	stringVector vectorKind = iota // text input, masked values and byte-array columns
+	boolVector
+	int32Vector
+	int64Vector
+	floatVector
+	doubleVector
+)
+
+// ColumnVector holds the values of one column of a batch. Parquet columns are
+// decoded by physical type into the matching slice, so columns that are not
+// masked reach the output without a round trip through strings; only the
+// slice for Kind is set. Nulls are kept apart from empty strings all the way
+// to the output. Format renders columns with a parquet logical type (dates,
+// timestamps, decimals, UUIDs). Columns inside parquet structs and lists also
+// carry Levels, and then hold one value per slot rather than per row.
+type ColumnVector struct {
+	Kind    vectorKind
+	Strings []string
+	Bools   []bool
+	Int32s  []int32
+	Int64s  []int64
+	Floats  []float32
+	Doubles []float64
+	Nulls   []bool // nil when no value is null
+	Format  *logicalFormat
+	Levels  *columnLevels // nil for top-level columns
+}
+
+// columnLevels places the values of a nested column in their rows. Every
+// slot holds a value, or marks a null or an empty list somewhere along the
+// column's path; the definition level tells which. Lists hold one slot per
+// element and rows are delimited by Offsets.
+type columnLevels struct {
+	Offsets []int   // row i is slots Offsets[i]:Offsets[i+1]; nil when every row is one slot
+	Defs    []int32 // definition level of each slot
+	Reps    []int32 // repetition level of each slot
+	MaxDef  int32   // definition level of slots that hold a value
+	ListDef int32   // definition level of slots that are list elements; 0 outside lists
+}
+
+// newColumnLevels reads the row boundaries off the repetition levels
+func newColumnLevels(defs, reps []int32, maxDef, listDef int32) *columnLevels {
+	levels := &columnLevels{Defs: defs, Reps: reps, MaxDef: maxDef, ListDef: listDef}
+	if listDef > 0 {
+		levels.Offsets = make([]int, 0, len(reps)+1)
+		for i, rl := range reps {
+			if rl == 0 {
+				levels.Offsets = append(levels.Offsets, i)
+			}
+		}
+		levels.Offsets = append(levels.Offsets, len(reps))
+	}
+	return levels
+}
+
+// newStringVector wraps values, none of which is null
+func newStringVector(values []string) *ColumnVector {
+	return &ColumnVector{Kind: stringVector, Strings: values}
+}
+
+// newStringColumns creates n empty string vectors with room for capacity values
+func newStringColumns(n, capacity int) []*ColumnVector {
+	columns := make([]*ColumnVector, n)
+	for i := range columns {
+		columns[i] = newStringVector(make([]string, 0, capacity))
+	}
+	return columns
+}
+
+// appendRow adds one value to each string vector of columns; fields equal to
+// nullToken are nulls
+func appendRow(columns []*ColumnVector, row []string, nullToken string) {
+	for i, value := range row {
+		if value == nullToken {
+			columns[i].appendString("", true)
+			continue
+		}
+		columns[i].appendString(value, false)
+	}
+}
+
+// appendString adds a value to a string vector; a null is stored as ""
+func (v *ColumnVector) appendString(value string, null bool) {
+	if null && v.Nulls == nil {
+		v.Nulls = make([]bool, len(v.Strings), cap(v.Strings))
+	}
+	v.Strings = append(v.Strings, value)
+	if v.Nulls != nil {
+		v.Nulls = append(v.Nulls, null)
+	}
+}
+
+// newParquetVector packs the values of a leaf column as returned by
+// parquet-go (nil for nulls) into a vector of its physical type
+func newParquetVector(values []interface{}, typ parquet.Type, format *logicalFormat) (*ColumnVector, error) {
+	n := len(values)
+	vec := &ColumnVector{Format: format}
+	switch typ {
+	case parquet.Type_BOOLEAN:
+		vec.Kind, vec.Bools = boolVector, make([]bool, n)
+	case parquet.Type_INT32:
+		vec.Kind, vec.Int32s = int32Vector, make([]int32, n)
+	case parquet.Type_INT64:
+		vec.Kind, vec.Int64s = int64Vector, make([]int64, n)
+	case parquet.Type_FLOAT:
+		vec.Kind, vec.Floats = floatVector, make([]float32, n)
+	case parquet.Type_DOUBLE:
+		vec.Kind, vec.Doubles = doubleVector, make([]float64, n)
+	default: // BYTE_ARRAY, FIXED_LEN_BYTE_ARRAY, INT96
+		vec.Kind, vec.Strings = stringVector, make([]string, n)
+	}
+
+	for i, value := range values {
+		if value == nil {
+			if vec.Nulls == nil {
+				vec.Nulls = make([]bool, n)
+			}
+			vec.Nulls[i] = true
+			continue
+		}
+
+		var ok bool
+		switch vec.Kind {
+		case boolVector:
+			vec.Bools[i], ok = value.(bool)
+		case int32Vector:
+			vec.Int32s[i], ok = value.(int32)
+		case int64Vector:
+			vec.Int64s[i], ok = value.(int64)
+		case floatVector:
+			vec.Floats[i], ok = value.(float32)
+		case doubleVector:
+			vec.Doubles[i], ok = value.(float64)
+		default:
+			vec.Strings[i], ok = value.(string)
+		}
+		if !ok {
+			return nil, fmt.Errorf("value %d is a %T, not %s", i, value, typ)
+		}
+	}
+	return vec, nil
+}
+
+// Len is the number of values, which is the number of slots for nested
+// columns
+func (v *ColumnVector) Len() int {
+	switch v.Kind {
+	case boolVector:
+		return len(v.Bools)
+	case int32Vector:
+		return len(v.Int32s)
+	case int64Vector:
+		return len(v.Int64s)
+	case floatVector:
+		return len(v.Floats)
+	case doubleVector:
+		return len(v.Doubles)
+	default:
+		return len(v.Strings)
+	}
+}
+
+// Rows is the number of rows the column has values for
+func (v *ColumnVector) Rows() int {
+	if v.Levels != nil && v.Levels.Offsets != nil {
+		return len(v.Levels.Offsets) - 1
+	}
+	return v.Len()
+}
+
+// slots returns the range of values that holds rows start to end
+func (v *ColumnVector) slots(start, end int) (int, int) {
+	if v.Levels != nil && v.Levels.Offsets != nil {
+		return v.Levels.Offsets[start], v.Levels.Offsets[end]
+	}
+	return start, end
+}
+
+// rowOf is the row holding slot, searching from row from onwards, so
+// walking the slots in order costs no more than walking the rows
+func (v *ColumnVector) rowOf(slot, from int) int {
+	if v.Levels == nil || v.Levels.Offsets == nil {
+		return slot
+	}
+	for v.Levels.Offsets[from+1] <= slot {
+		from++
+	}
+	return from
+}
+
+// def is the definition level of slot i; top-level values are fully defined
+func (v *ColumnVector) def(i int) int32 {
+	if v.Levels == nil {
+		return 0
+	}
+	return v.Levels.Defs[i]
+}
+
+// elements is the number of list elements in row; slot holds the first
+func (v *ColumnVector) elements(row int) (slot, n int) {
+	start, end := v.slots(row, row+1)
+	if v.def(start) < v.Levels.ListDef {
+		return start, 0
+	}
+	return start, end - start
+}
+
+func (v *ColumnVector) IsNull(i int) bool {
+	return v.Nulls != nil && v.Nulls[i]
+}
+
+// String renders value i as text; a null renders as "", so check IsNull
+// where the difference matters
+func (v *ColumnVector) String(i int) string {
+	if v.IsNull(i) {
+		return ""
+	}
+	if v.Format != nil {
+		return v.Format.render(v.Value(i))
+	}
+
+	switch v.Kind {
+	case boolVector:
+		return strconv.FormatBool(v.Bools[i])
+	case int32Vector:
+		return strconv.FormatInt(int64(v.Int32s[i]), 10)
+	case int64Vector:
+		return strconv.FormatInt(v.Int64s[i], 10)
+	case floatVector:
+		return strconv.FormatFloat(float64(v.Floats[i]), 'f', -1, 32)
+	case doubleVector:
+		return strconv.FormatFloat(v.Doubles[i], 'f', -1, 64)
+	default:
+		return v.Strings[i]
+	}
+}
+
+// Value returns value i as its Go type, or nil when it is null
+func (v *ColumnVector) Value(i int) interface{} {
+	if v.IsNull(i) {
+		return nil
+	}
+
+	switch v.Kind {
+	case boolVector:
+		return v.Bools[i]
+	case int32Vector:
+		return v.Int32s[i]
+	case int64Vector:
+		return v.Int64s[i]
+	case floatVector:
+		return v.Floats[i]
+	case doubleVector:
+		return v.Doubles[i]
+	default:
+		return v.Strings[i]
+	}
+}
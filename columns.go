@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/xitongsys/parquet-go/parquet"
+)
+
+// Schema describes the columns of a RowSource, handed on to the RowSink
+type Schema struct {
+	Columns []ColumnInfo
+
+	// Parquet is the source file metadata when the input is parquet; sinks
+	// that can reproduce it (parquet output) use it, others ignore it. Other
+	// sources leave it nil and parquet output writes every column as a string.
+	Parquet *parquet.FileMetaData
+
+	// Fields is the record structure of nested parquet input, which JSON
+	// Lines output reproduces; nil when every column is top-level
+	Fields []*fieldNode
+}
+
+// ColumnInfo describes one leaf column of the input
+type ColumnInfo struct {
+	Name string                 // header name
+	Path string                 // dotted path from the root, e.g. address.street
+	Leaf *parquet.SchemaElement // field type when read from parquet, else nil
+	Type valueType              // JSON type the values are written as
+}
+
+// valueType is the JSON type of a column's values. JSON Lines output writes
+// values of number, boolean and object columns as those types, and falls
+// back to a string for values that don't fit (e.g. a redacted number).
+type valueType int
+
+const (
+	textValue   valueType = iota // strings, and columns of mixed or unknown type
+	numberValue                  // JSON numbers
+	boolValue                    // true or false
+	objectValue                  // JSON objects or arrays
+)
+
+// parquetValueType keeps plain numbers and booleans typed; logical types,
+// decimals included so their precision survives, are written as text
+func parquetValueType(el *parquet.SchemaElement) valueType {
+	if newLogicalFormat(el, nil) != nil {
+		return textValue
+	}
+	switch el.GetType() {
+	case parquet.Type_BOOLEAN:
+		return boolValue
+	case parquet.Type_INT32, parquet.Type_INT64, parquet.Type_FLOAT, parquet.Type_DOUBLE:
+		return numberValue
+	}
+	return textValue
+}
+
+func columnNames(columns []ColumnInfo) []string {
+	names := make([]string, len(columns))
+	for i, col := range columns {
+		names[i] = col.Name
+	}
+	return names
+}
+
+// parseColumns splits a comma-separated list of column selectors. A selector
+// is a zero-based index, a column name, a dotted path (address.street) or a
+// glob over paths (*_email, address.*).
+func parseColumns(columnStr string) ([]string, error) {
+	if columnStr == "" {
+		return []string{"3"}, nil // Default to column 3
+	}
+
+	parts := strings.Split(columnStr, ",")
+	selectors := make([]string, 0, len(parts))
+
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		if col, err := strconv.Atoi(part); err == nil && col < 0 {
+			return nil, fmt.Errorf("column index must be non-negative, got %d", col)
+		}
+
+		if strings.ContainsAny(part, "*?[") {
+			if _, err := path.Match(part, ""); err != nil {
+				return nil, fmt.Errorf("invalid column pattern '%s': %w", part, err)
+			}
+		}
+
+		selectors = append(selectors, part)
+	}
+
+	if len(selectors) == 0 {
+		return []string{"3"}, nil // Default to column 3
+	}
+
+	return selectors, nil
+}
+
+// resolveColumnSelector returns the indexes of the columns matched by
+// selector. Names and paths are compared case-insensitively, and list
+// elements may be named with or without [*] (phones[*].number or
+// phones.number); only a selector that names no column exactly is used as a
+// glob. A selector that matches nothing is an error listing the available
+// columns.
+func resolveColumnSelector(selector string, columns []ColumnInfo) ([]int, error) {
+	selector = strings.TrimSpace(selector)
+	if selector == "" {
+		return nil, fmt.Errorf("empty column selector")
+	}
+
+	if index, err := strconv.Atoi(selector); err == nil {
+		if index < 0 || index >= len(columns) {
+			return nil, fmt.Errorf("column index %d out of range (input has %d columns: %s)", index, len(columns), availableColumns(columns))
+		}
+		return []int{index}, nil
+	}
+
+	pattern := strings.ToLower(selector)
+
+	var matches []int
+	for i, col := range columns {
+		p, n := strings.ToLower(col.Path), strings.ToLower(col.Name)
+		if pattern == p || pattern == n || pattern == strings.ReplaceAll(p, "[*]", "") {
+			matches = append(matches, i)
+		}
+	}
+
+	if len(matches) == 0 && strings.ContainsAny(pattern, "*?[") {
+		for i, col := range columns {
+			mp, err := path.Match(pattern, strings.ToLower(col.Path))
+			if err != nil {
+				return nil, fmt.Errorf("invalid column pattern '%s': %w", selector, err)
+			}
+			mn, _ := path.Match(pattern, strings.ToLower(col.Name))
+			if mp || mn {
+				matches = append(matches, i)
+			}
+		}
+	}
+
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("column '%s' not found; available columns: %s", selector, availableColumns(columns))
+	}
+	return matches, nil
+}
+
+// resolveColumns resolves every selector, reporting each index once in the
+// order first matched
+func resolveColumns(selectors []string, columns []ColumnInfo) ([]int, error) {
+	var indexes []int
+	seen := make(map[int]bool)
+
+	for _, selector := range selectors {
+		matches, err := resolveColumnSelector(selector, columns)
+		if err != nil {
+			return nil, err
+		}
+		for _, index := range matches {
+			if !seen[index] {
+				seen[index] = true
+				indexes = append(indexes, index)
+			}
+		}
+	}
+
+	return indexes, nil
+}
+
+func availableColumns(columns []ColumnInfo) string {
+	paths := make([]string, len(columns))
+	for i, col := range columns {
+		paths[i] = col.Path
+	}
+	return strings.Join(paths, ", ")
+}
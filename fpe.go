@@ -0,0 +1,538 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FPEMode selects the NIST SP 800-38G format-preserving encryption algorithm
+type FPEMode string
+
+const (
+	FF1  FPEMode = "ff1"
+	FF31 FPEMode = "ff3-1"
+)
+
+// ff31TweakLen is the fixed FF3-1 tweak size (56 bits)
+const ff31TweakLen = 7
+
+// fpeMinDomain is the minimum radix^len allowed by SP 800-38G Rev. 1
+const fpeMinDomain = 1000000
+
+// errFPEDomainTooSmall is returned for inputs below fpeMinDomain
+var errFPEDomainTooSmall = errors.New("domain too small for FPE")
+
+// fpeAlphabets lists the character sets values can be encrypted over.
+// Characters outside the selected alphabet are left in place.
+var fpeAlphabets = map[string]string{
+	"digits":       "0123456789",
+	"lowercase":    "abcdefghijklmnopqrstuvwxyz",
+	"uppercase":    "ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	"alphanumeric": "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz",
+}
+
+// fpeAlphabetNames returns the supported alphabet names in a stable order
+func fpeAlphabetNames() []string {
+	names := make([]string, 0, len(fpeAlphabets))
+	for name := range fpeAlphabets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// deriveFPEKey turns the masking secret into an AES-256 key so the same
+// -mask_key/-mask_key_file/$MASKING_KEY can drive both keyed substitution and FPE
+func deriveFPEKey(secret []byte) []byte {
+	return deriveKey(secret, "go_masking fpe aes-256 key")
+}
+
+// deriveKey derives a key for one purpose from the masking secret
+func deriveKey(secret []byte, label string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// parseFPETweak decodes a hex tweak, enforcing the FF3-1 length when needed.
+// An empty tweak is allowed for FF1 and means seven zero bytes for FF3-1.
+func parseFPETweak(mode FPEMode, tweakHex string) ([]byte, error) {
+	tweak, err := hex.DecodeString(tweakHex)
+	if err != nil {
+		return nil, fmt.Errorf("tweak must be hex encoded: %w", err)
+	}
+
+	if mode == FF31 {
+		if len(tweak) == 0 {
+			return make([]byte, ff31TweakLen), nil
+		}
+		if len(tweak) != ff31TweakLen {
+			return nil, fmt.Errorf("FF3-1 tweak must be %d bytes, got %d", ff31TweakLen, len(tweak))
+		}
+	}
+
+	return tweak, nil
+}
+
+// fpeCipher encrypts and decrypts strings of numerals in [0, radix)
+type fpeCipher interface {
+	encrypt(x []int) ([]int, error)
+	decrypt(x []int) ([]int, error)
+}
+
+func newFPECipher(mode FPEMode, key []byte, radix int, tweak []byte) (fpeCipher, error) {
+	switch mode {
+	case FF1:
+		return newFF1Cipher(key, radix, tweak)
+	case FF31:
+		return newFF31Cipher(key, radix, tweak)
+	default:
+		return nil, fmt.Errorf("unknown FPE mode '%s' (expected %s or %s)", mode, FF1, FF31)
+	}
+}
+
+// numRadix interprets numerals as a big-endian number in the given radix
+func numRadix(x []int, radix int) *big.Int {
+	r := big.NewInt(int64(radix))
+	n := new(big.Int)
+	for _, d := range x {
+		n.Mul(n, r)
+		n.Add(n, big.NewInt(int64(d)))
+	}
+	return n
+}
+
+// strRadix renders n as exactly m big-endian numerals in the given radix
+func strRadix(n *big.Int, radix, m int) []int {
+	r := big.NewInt(int64(radix))
+	x := new(big.Int).Set(n)
+	d := new(big.Int)
+	out := make([]int, m)
+	for i := m - 1; i >= 0; i-- {
+		x.DivMod(x, r, d)
+		out[i] = int(d.Int64())
+	}
+	return out
+}
+
+func reverseNumerals(x []int) []int {
+	out := make([]int, len(x))
+	for i, d := range x {
+		out[len(x)-1-i] = d
+	}
+	return out
+}
+
+func reverseBytes(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i, c := range b {
+		out[len(b)-1-i] = c
+	}
+	return out
+}
+
+func checkNumerals(x []int, radix int) error {
+	for _, d := range x {
+		if d < 0 || d >= radix {
+			return fmt.Errorf("numeral %d out of range for radix %d", d, radix)
+		}
+	}
+	return nil
+}
+
+// checkMinLength enforces radix^n >= 1,000,000
+func checkMinLength(n, radix int) error {
+	domain := new(big.Int).Exp(big.NewInt(int64(radix)), big.NewInt(int64(n)), nil)
+	if domain.Cmp(big.NewInt(fpeMinDomain)) < 0 {
+		return fmt.Errorf("%w: input of length %d is too short for radix %d (domain must be at least %d)", errFPEDomainTooSmall, n, radix, fpeMinDomain)
+	}
+	return nil
+}
+
+// ff1Cipher implements FF1 from NIST SP 800-38G
+type ff1Cipher struct {
+	block cipher.Block
+	radix int
+	tweak []byte
+}
+
+func newFF1Cipher(key []byte, radix int, tweak []byte) (*ff1Cipher, error) {
+	if radix < 2 || radix > 1<<16 {
+		return nil, fmt.Errorf("FF1 radix must be in [2, 65536], got %d", radix)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid FF1 key: %w", err)
+	}
+
+	return &ff1Cipher{block: block, radix: radix, tweak: tweak}, nil
+}
+
+// prf is AES CBC-MAC with a zero IV over a whole number of blocks
+func (c *ff1Cipher) prf(data []byte) []byte {
+	y := make([]byte, aes.BlockSize)
+	for off := 0; off < len(data); off += aes.BlockSize {
+		for j := 0; j < aes.BlockSize; j++ {
+			y[j] ^= data[off+j]
+		}
+		c.block.Encrypt(y, y)
+	}
+	return y
+}
+
+// roundValue computes y = NUM(S) for one Feistel round
+func (c *ff1Cipher) roundValue(p []byte, round int, b, d int, half []int) *big.Int {
+	t := len(c.tweak)
+	pad := ((-t-b-1)%16 + 16) % 16
+
+	q := make([]byte, 0, t+pad+1+b)
+	q = append(q, c.tweak...)
+	q = append(q, make([]byte, pad)...)
+	q = append(q, byte(round))
+	numBytes := numRadix(half, c.radix).Bytes()
+	q = append(q, make([]byte, b-len(numBytes))...)
+	q = append(q, numBytes...)
+
+	r := c.prf(append(append([]byte{}, p...), q...))
+
+	s := make([]byte, 0, d+aes.BlockSize)
+	s = append(s, r...)
+	for j := 1; len(s) < d; j++ {
+		blk := make([]byte, aes.BlockSize)
+		copy(blk, r)
+		ctr := big.NewInt(int64(j)).Bytes()
+		for k := range ctr {
+			blk[aes.BlockSize-len(ctr)+k] ^= ctr[k]
+		}
+		c.block.Encrypt(blk, blk)
+		s = append(s, blk...)
+	}
+
+	return new(big.Int).SetBytes(s[:d])
+}
+
+func (c *ff1Cipher) params(n int) (u, v, b, d int, p []byte) {
+	u = n / 2
+	v = n - u
+
+	maxB := new(big.Int).Exp(big.NewInt(int64(c.radix)), big.NewInt(int64(v)), nil)
+	maxB.Sub(maxB, big.NewInt(1))
+	b = (maxB.BitLen() + 7) / 8
+	d = 4*((b+3)/4) + 4
+
+	t := len(c.tweak)
+	p = []byte{
+		1, 2, 1,
+		byte(c.radix >> 16), byte(c.radix >> 8), byte(c.radix),
+		10, byte(u),
+		byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n),
+		byte(t >> 24), byte(t >> 16), byte(t >> 8), byte(t),
+	}
+	return u, v, b, d, p
+}
+
+func (c *ff1Cipher) encrypt(x []int) ([]int, error) {
+	return c.crypt(x, true)
+}
+
+func (c *ff1Cipher) decrypt(x []int) ([]int, error) {
+	return c.crypt(x, false)
+}
+
+func (c *ff1Cipher) crypt(x []int, encrypt bool) ([]int, error) {
+	n := len(x)
+	if err := checkNumerals(x, c.radix); err != nil {
+		return nil, err
+	}
+	if err := checkMinLength(n, c.radix); err != nil {
+		return nil, err
+	}
+
+	u, v, b, d, p := c.params(n)
+	a := append([]int{}, x[:u]...)
+	bb := append([]int{}, x[u:]...)
+	radix := big.NewInt(int64(c.radix))
+
+	for step := 0; step < 10; step++ {
+		i := step
+		if !encrypt {
+			i = 9 - step
+		}
+
+		m := u
+		if i%2 == 1 {
+			m = v
+		}
+		mod := new(big.Int).Exp(radix, big.NewInt(int64(m)), nil)
+
+		if encrypt {
+			y := c.roundValue(p, i, b, d, bb)
+			cv := numRadix(a, c.radix)
+			cv.Add(cv, y).Mod(cv, mod)
+			a, bb = bb, strRadix(cv, c.radix, m)
+		} else {
+			y := c.roundValue(p, i, b, d, a)
+			cv := numRadix(bb, c.radix)
+			cv.Sub(cv, y).Mod(cv, mod)
+			a, bb = strRadix(cv, c.radix, m), a
+		}
+	}
+
+	return append(a, bb...), nil
+}
+
+// ff31Cipher implements FF3-1 from NIST SP 800-38G Rev. 1
+type ff31Cipher struct {
+	block  cipher.Block
+	radix  int
+	tweakL []byte
+	tweakR []byte
+}
+
+func newFF31Cipher(key []byte, radix int, tweak []byte) (*ff31Cipher, error) {
+	if radix < 2 || radix > 1<<16 {
+		return nil, fmt.Errorf("FF3-1 radix must be in [2, 65536], got %d", radix)
+	}
+	if len(tweak) != ff31TweakLen {
+		return nil, fmt.Errorf("FF3-1 tweak must be %d bytes, got %d", ff31TweakLen, len(tweak))
+	}
+
+	block, err := aes.NewCipher(reverseBytes(key))
+	if err != nil {
+		return nil, fmt.Errorf("invalid FF3-1 key: %w", err)
+	}
+
+	// T_L = T[0..27] || 0^4, T_R = T[32..55] || T[28..31] || 0^4
+	tweakL := []byte{tweak[0], tweak[1], tweak[2], tweak[3] & 0xF0}
+	tweakR := []byte{tweak[4], tweak[5], tweak[6], (tweak[3] & 0x0F) << 4}
+
+	return &ff31Cipher{block: block, radix: radix, tweakL: tweakL, tweakR: tweakR}, nil
+}
+
+func (c *ff31Cipher) checkLength(n int) error {
+	if err := checkMinLength(n, c.radix); err != nil {
+		return err
+	}
+
+	// maxlen = 2 * floor(log_radix(2^96)), i.e. radix^ceil(n/2) <= 2^96
+	u := (n + 1) / 2
+	half := new(big.Int).Exp(big.NewInt(int64(c.radix)), big.NewInt(int64(u)), nil)
+	if half.Cmp(new(big.Int).Lsh(big.NewInt(1), 96)) > 0 {
+		return fmt.Errorf("input of length %d is too long for FF3-1 with radix %d", n, c.radix)
+	}
+	return nil
+}
+
+// roundValue computes y = NUM(REVB(CIPH(REVB(P)))) for one Feistel round
+func (c *ff31Cipher) roundValue(round int, w []byte, half []int) *big.Int {
+	p := make([]byte, aes.BlockSize)
+	copy(p, w)
+	p[3] ^= byte(round)
+
+	numBytes := numRadix(reverseNumerals(half), c.radix).Bytes()
+	copy(p[aes.BlockSize-len(numBytes):], numBytes)
+
+	s := reverseBytes(p)
+	c.block.Encrypt(s, s)
+	return new(big.Int).SetBytes(reverseBytes(s))
+}
+
+func (c *ff31Cipher) encrypt(x []int) ([]int, error) {
+	return c.crypt(x, true)
+}
+
+func (c *ff31Cipher) decrypt(x []int) ([]int, error) {
+	return c.crypt(x, false)
+}
+
+func (c *ff31Cipher) crypt(x []int, encrypt bool) ([]int, error) {
+	n := len(x)
+	if err := checkNumerals(x, c.radix); err != nil {
+		return nil, err
+	}
+	if err := c.checkLength(n); err != nil {
+		return nil, err
+	}
+
+	u := (n + 1) / 2
+	v := n - u
+	a := append([]int{}, x[:u]...)
+	b := append([]int{}, x[u:]...)
+	radix := big.NewInt(int64(c.radix))
+
+	for step := 0; step < 8; step++ {
+		i := step
+		if !encrypt {
+			i = 7 - step
+		}
+
+		m, w := u, c.tweakR
+		if i%2 == 1 {
+			m, w = v, c.tweakL
+		}
+		mod := new(big.Int).Exp(radix, big.NewInt(int64(m)), nil)
+
+		if encrypt {
+			y := c.roundValue(i, w, b)
+			cv := numRadix(reverseNumerals(a), c.radix)
+			cv.Add(cv, y).Mod(cv, mod)
+			a, b = b, reverseNumerals(strRadix(cv, c.radix, m))
+		} else {
+			y := c.roundValue(i, w, a)
+			cv := numRadix(reverseNumerals(b), c.radix)
+			cv.Sub(cv, y).Mod(cv, mod)
+			a, b = reverseNumerals(strRadix(cv, c.radix, m)), a
+		}
+	}
+
+	return append(a, b...), nil
+}
+
+// FPEMasker encrypts the characters of a value that belong to its alphabet and
+// leaves every other character (separators, spaces, other scripts) in place, so
+// length and character classes survive and the value can be decrypted again.
+// Values with too few alphabet characters for the NIST minimum domain can't be
+// encrypted: they are an error unless SubstituteShortValues was called, when
+// they get a one-way keyed substitution that unmask can't reverse.
+type FPEMasker struct {
+	cipher     fpeCipher
+	alphabet   []rune
+	index      map[rune]int
+	shortKey   []byte // keys the substitution of values that are too short
+	substitute bool   // substitute short values instead of failing
+	warnMask   sync.Once
+}
+
+// Handling of values too short for FPE, as accepted by -fpe_short_values and
+// the short_values policy parameter
+const (
+	fpeShortError      = "error"
+	fpeShortSubstitute = "substitute"
+)
+
+// errFPEOneWay is returned by Unmask for values that were too short to
+// encrypt and so were substituted one-way
+var errFPEOneWay = errors.New("value was too short for FPE and was substituted one-way; it can't be unmasked")
+
+// NewFPEMasker creates a reversible masker for the given mode and alphabet name
+func NewFPEMasker(mode FPEMode, key, tweak []byte, alphabetName string) (*FPEMasker, error) {
+	chars, ok := fpeAlphabets[alphabetName]
+	if !ok {
+		return nil, fmt.Errorf("unknown FPE alphabet '%s' (expected one of %s)", alphabetName, strings.Join(fpeAlphabetNames(), ", "))
+	}
+	if len(key) == 0 {
+		return nil, errors.New("FPE requires a masking key")
+	}
+
+	alphabet := []rune(chars)
+	index := make(map[rune]int, len(alphabet))
+	for i, r := range alphabet {
+		index[r] = i
+	}
+
+	c, err := newFPECipher(mode, deriveFPEKey(key), len(alphabet), tweak)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FPEMasker{
+		cipher:   c,
+		alphabet: alphabet,
+		index:    index,
+		shortKey: deriveKey(key, "go_masking fpe short value key"),
+	}, nil
+}
+
+// SubstituteShortValues makes Mask substitute values too short to encrypt
+// one-way instead of failing, and Unmask report them with errFPEOneWay. It
+// must be called before the masker is used.
+func (fm *FPEMasker) SubstituteShortValues() {
+	fm.substitute = true
+}
+
+// Mask encrypts the alphabet characters of value, or substitutes them when
+// value is too short to encrypt and short values are substituted
+func (fm *FPEMasker) Mask(value string) (string, error) {
+	masked, err := fm.transform(value, fm.cipher.encrypt)
+	if !errors.Is(err, errFPEDomainTooSmall) {
+		return masked, err
+	}
+	if !fm.substitute {
+		return "", fmt.Errorf("%w; set short_values: %s (or -fpe_short_values %s) to mask such values one-way", err, fpeShortSubstitute, fpeShortSubstitute)
+	}
+	fm.warnMask.Do(func() {
+		warnFPE("Values too short for FPE are substituted one-way and can't be unmasked", err)
+	})
+	return fm.substituteShort(value), nil
+}
+
+// Unmask reverses Mask. A value too short to have been encrypted was
+// substituted one-way, so it gives errFPEOneWay, or an error saying it can't
+// have come from Mask unless short values are substituted.
+func (fm *FPEMasker) Unmask(value string) (string, error) {
+	plain, err := fm.transform(value, fm.cipher.decrypt)
+	if errors.Is(err, errFPEDomainTooSmall) && fm.substitute {
+		return "", errFPEOneWay
+	}
+	return plain, err
+}
+
+// substituteShort replaces the alphabet characters of value with ones drawn
+// from a key stream of the value, so equal values still mask alike
+func (fm *FPEMasker) substituteShort(value string) string {
+	src := newKeyStream(fm.shortKey, value)
+	runes := []rune(value)
+	for i, r := range runes {
+		if _, ok := fm.index[r]; ok {
+			runes[i] = fm.alphabet[src.Intn(len(fm.alphabet))]
+		}
+	}
+	return string(runes)
+}
+
+func warnFPE(message string, err error) {
+	if logger != nil {
+		logger.Warn(message, map[string]interface{}{"first": err.Error()})
+	}
+}
+
+func (fm *FPEMasker) transform(value string, crypt func([]int) ([]int, error)) (string, error) {
+	if value == "" {
+		return value, nil
+	}
+
+	runes := []rune(value)
+	positions := make([]int, 0, len(runes))
+	numerals := make([]int, 0, len(runes))
+	for i, r := range runes {
+		if d, ok := fm.index[r]; ok {
+			positions = append(positions, i)
+			numerals = append(numerals, d)
+		}
+	}
+
+	// Nothing to encrypt (e.g. a value made only of separators)
+	if len(numerals) == 0 {
+		return value, nil
+	}
+
+	out, err := crypt(numerals)
+	if err != nil {
+		return "", err
+	}
+
+	for i, pos := range positions {
+		runes[pos] = fm.alphabet[out[i]]
+	}
+	return string(runes), nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// base36 spells numerals for the sample radixes (10, 26 and 36)
+const base36 = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+func numerals(t *testing.T, s string) []int {
+	t.Helper()
+	x := make([]int, len(s))
+	for i, r := range s {
+		x[i] = strings.IndexRune(base36, r)
+		if x[i] < 0 {
+			t.Fatalf("'%c' is not a base-36 numeral", r)
+		}
+	}
+	return x
+}
+
+func spell(x []int) string {
+	var sb strings.Builder
+	for _, d := range x {
+		sb.WriteByte(base36[d])
+	}
+	return sb.String()
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+type fpeVector struct {
+	key, tweak          string
+	radix               int
+	plaintext, expected string
+}
+
+// checkVectors encrypts and decrypts each vector with the cipher made by build
+func checkVectors(t *testing.T, vectors []fpeVector, build func(key []byte, radix int, tweak []byte) (fpeCipher, error)) {
+	for i, v := range vectors {
+		c, err := build(mustHex(t, v.key), v.radix, mustHex(t, v.tweak))
+		if err != nil {
+			t.Fatalf("sample %d: %v", i+1, err)
+		}
+
+		ct, err := c.encrypt(numerals(t, v.plaintext))
+		if err != nil {
+			t.Fatalf("sample %d: encrypt: %v", i+1, err)
+		}
+		if got := spell(ct); got != v.expected {
+			t.Errorf("sample %d: encrypt = %s, want %s", i+1, got, v.expected)
+		}
+
+		pt, err := c.decrypt(ct)
+		if err != nil {
+			t.Fatalf("sample %d: decrypt: %v", i+1, err)
+		}
+		if got := spell(pt); got != v.plaintext {
+			t.Errorf("sample %d: decrypt = %s, want %s", i+1, got, v.plaintext)
+		}
+	}
+}
+
+// TestFF1Samples checks the NIST SP 800-38G FF1 samples
+func TestFF1Samples(t *testing.T) {
+	const (
+		aes128 = "2B7E151628AED2A6ABF7158809CF4F3C"
+		aes192 = aes128 + "EF4359D8D580AA4F"
+		aes256 = aes192 + "7F036D6F04FC6A94"
+		tweak  = "39383736353433323130"
+		tweak3 = "3737373770717273373737"
+	)
+	vectors := []fpeVector{
+		{aes128, "", 10, "0123456789", "2433477484"},
+		{aes128, tweak, 10, "0123456789", "6124200773"},
+		{aes128, tweak3, 36, "0123456789abcdefghi", "a9tv40mll9kdu509eum"},
+		{aes192, "", 10, "0123456789", "2830668132"},
+		{aes192, tweak, 10, "0123456789", "2496655549"},
+		{aes192, tweak3, 36, "0123456789abcdefghi", "xbj3kv35jrawxv32ysr"},
+		{aes256, "", 10, "0123456789", "6657667009"},
+		{aes256, tweak, 10, "0123456789", "1001623463"},
+		{aes256, tweak3, 36, "0123456789abcdefghi", "xs8a0azh2avyalyzuwd"},
+	}
+	checkVectors(t, vectors, func(key []byte, radix int, tweak []byte) (fpeCipher, error) {
+		return newFF1Cipher(key, radix, tweak)
+	})
+}
+
+// TestFF3Samples checks the NIST FF3 samples. FF3-1 only changes how the
+// tweak is split, so the 64-bit sample tweaks are set as T_L and T_R directly.
+func TestFF3Samples(t *testing.T) {
+	const (
+		aes128 = "EF4359D8D580AA4F7F036D6F04FC6A94"
+		aes192 = aes128 + "2B7E151628AED2A6"
+		aes256 = aes192 + "ABF7158809CF4F3C"
+		tweak1 = "D8E7920AFA330A73"
+		tweak2 = "9A768A92F60E12D8"
+		zero   = "0000000000000000"
+		short  = "890121234567890000"
+		long   = "89012123456789000000789000000"
+		radix  = "0123456789abcdefghi"
+	)
+	vectors := []fpeVector{
+		{aes128, tweak1, 10, short, "750918814058654607"},
+		{aes128, tweak2, 10, short, "018989839189395384"},
+		{aes128, tweak1, 10, long, "48598367162252569629397416226"},
+		{aes128, zero, 10, long, "34695224821734535122613701434"},
+		{aes128, tweak2, 26, radix, "g2pk40i992fn20cjakb"},
+		{aes192, tweak1, 10, short, "646965393875028755"},
+		{aes192, tweak2, 10, short, "961610514491424446"},
+		{aes192, tweak1, 10, long, "53048884065350204541786380807"},
+		{aes192, zero, 10, long, "98083802678820389295041483512"},
+		{aes192, tweak2, 26, radix, "i0ihe2jfj7a9opf9p88"},
+		{aes256, tweak1, 10, short, "922011205562777495"},
+		{aes256, tweak2, 10, short, "504149865578056140"},
+		{aes256, tweak1, 10, long, "04344343235792599165734622699"},
+		{aes256, zero, 10, long, "30859239999374053872365555822"},
+		{aes256, tweak2, 26, radix, "p0b2godfja9bhb7bk38"},
+	}
+	checkVectors(t, vectors, func(key []byte, radix int, tweak []byte) (fpeCipher, error) {
+		c, err := newFF31Cipher(key, radix, make([]byte, ff31TweakLen))
+		if err != nil {
+			return nil, err
+		}
+		c.tweakL, c.tweakR = tweak[:4], tweak[4:]
+		return c, nil
+	})
+}
+
+// TestFF31Samples checks FF3-1 with 56-bit tweaks against the NIST ACVP
+// vectors
+func TestFF31Samples(t *testing.T) {
+	vectors := []fpeVector{
+		{"AD41EC5D2356DEAE53AE76F50B4BA6D2", "CF29DA1E18D970", 10, "6520935496", "4716569208"},
+	}
+	checkVectors(t, vectors, func(key []byte, radix int, tweak []byte) (fpeCipher, error) {
+		return newFF31Cipher(key, radix, tweak)
+	})
+}
+
+func TestFF31TweakSplit(t *testing.T) {
+	c, err := newFF31Cipher(make([]byte, 16), 10, mustHex(t, "11223344556677"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(c.tweakL); got != "11223340" {
+		t.Errorf("T_L = %s, want 11223340", got)
+	}
+	if got := hex.EncodeToString(c.tweakR); got != "55667740" {
+		t.Errorf("T_R = %s, want 55667740", got)
+	}
+}
+
+func TestFPEMaskerRoundTrip(t *testing.T) {
+	for _, mode := range []FPEMode{FF1, FF31} {
+		fm, err := NewFPEMasker(mode, []byte("secret"), make([]byte, ff31TweakLen), "alphanumeric")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, value := range []string{"4111-1111-1111-1234", "AB12 cd34 ef56", "Zürich 8001 CH"} {
+			masked, err := fm.Mask(value)
+			if err != nil {
+				t.Fatalf("%s: Mask(%q): %v", mode, value, err)
+			}
+			if masked == value || len([]rune(masked)) != len([]rune(value)) {
+				t.Errorf("%s: Mask(%q) = %q", mode, value, masked)
+			}
+			if plain, err := fm.Unmask(masked); err != nil || plain != value {
+				t.Errorf("%s: Unmask(%q) = %q, %v; want %q", mode, masked, plain, err, value)
+			}
+		}
+	}
+}
+
+// TestFPEMaskerShortValues checks that values below the minimum domain fail
+// by default, and that when substituted one-way they can't be unmasked
+func TestFPEMaskerShortValues(t *testing.T) {
+	fm, err := NewFPEMasker(FF1, []byte("secret"), nil, "digits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if masked, err := fm.Mask("12-34"); err == nil || strings.Contains(err.Error(), "12") {
+		t.Errorf("Mask(12-34) = %q, %v; want an error that doesn't show the value", masked, err)
+	}
+	if plain, err := fm.Unmask("12-34"); err == nil || errors.Is(err, errFPEOneWay) {
+		t.Errorf("Unmask(12-34) = %q, %v; want an error, as Mask never gives such values", plain, err)
+	}
+
+	fm.SubstituteShortValues()
+	masked, err := fm.Mask("12-34")
+	if err != nil {
+		t.Fatalf("Mask: %v", err)
+	}
+	if len(masked) != 5 || masked[2] != '-' || strings.Trim(masked, "0123456789-") != "" {
+		t.Errorf("Mask(12-34) = %q, want four digits around the dash", masked)
+	}
+	if again, _ := fm.Mask("12-34"); again != masked {
+		t.Errorf("Mask(12-34) = %q then %q", masked, again)
+	}
+	if plain, err := fm.Unmask(masked); !errors.Is(err, errFPEOneWay) {
+		t.Errorf("Unmask(%q) = %q, %v; want errFPEOneWay", masked, plain, err)
+	}
+}
+
+// TestUnmaskOneWayValues checks that unmask writes values substituted one-way
+// as null rather than passing them off as originals
+func TestUnmaskOneWayValues(t *testing.T) {
+	fm, err := NewFPEMasker(FF1, []byte("secret"), nil, "digits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fm.SubstituteShortValues()
+
+	values := []string{"4111111111111234", "12"}
+	masked := make([]string, len(values))
+	for i, v := range values {
+		if masked[i], err = fm.Mask(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	batch := Batch{Columns: []*ColumnVector{newStringVector(masked)}}
+	oneWay, err := unmaskColumns(batch, []int{0}, fm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	col := batch.Columns[0]
+	if oneWay != 1 || col.String(0) != values[0] || col.IsNull(0) || !col.IsNull(1) {
+		t.Errorf("unmasked to %q (null %v), %q (null %v) with %d one-way; want %s and a null",
+			col.String(0), col.IsNull(0), col.String(1), col.IsNull(1), oneWay, values[0])
+	}
+}
@@ -1,113 +1,345 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
 	"math/rand"
 	"runtime"
 	"sync"
 )
 
+// Masker transforms a single cell value. MaskingService (random or keyed
+// substitution) and FPEMasker (reversible encryption) both implement it.
+type Masker interface {
+	Mask(value string) (string, error)
+}
+
+// rowMasker is a Masker whose result can also depend on another column of
+// the same row, such as date shifting by entity. That column must not be
+// inside a list; rows where it is null are masked with Mask.
+type rowMasker interface {
+	Masker
+	relatedColumn() int // -1 when the masker doesn't use one
+	MaskRow(value, related string) (string, error)
+}
+
+// ColumnMasker binds a masker to the index of the column it applies to.
+// KeepNulls leaves null values null instead of masking them.
+type ColumnMasker struct {
+	Index     int
+	Masker    Masker
+	KeepNulls bool
+}
+
 type MaskingService struct {
-	mapMask (map[string]string)
-	rwMutex sync.RWMutex
+	cache    *maskCache
+	key      []byte
+	preserve map[CharClass]bool
+	domain   string        // vault domain the substitutions belong to
+	vault    *vaultDomain  // nil without -vault
+	unique   *reverseIndex // nil unless distinct inputs must stay distinct
+	changes  *stateJournal // new substitutions for the next checkpoint
 }
 
 func NewMaskingService() *MaskingService {
 	return &MaskingService{
-		mapMask: make(map[string]string),
+		cache: newMaskCache(),
+	}
+}
+
+// NewKeyedMaskingService creates a masking service whose substitutions are
+// derived from HMAC-SHA256 over the input, so the same input masks to the same
+// output across runs and machines as long as the key is unchanged
+func NewKeyedMaskingService(key []byte) *MaskingService {
+	ms := NewMaskingService()
+	ms.key = key
+	return ms
+}
+
+// PreserveClasses keeps characters of the given classes unchanged instead of
+// substituting them. It must be called before the service is used.
+func (ms *MaskingService) PreserveClasses(classes map[CharClass]bool) {
+	ms.preserve = classes
+}
+
+// RequireUnique makes the service give every distinct input a distinct
+// substitution, drawing again on a collision, as key columns need. It must
+// be called before the service is used.
+func (ms *MaskingService) RequireUnique() {
+	ms.unique = newReverseIndex()
+}
+
+// intSource draws the replacement characters used by maskValue
+type intSource interface {
+	Intn(n int) int
+}
+
+// randSource draws from the shared math/rand generator (non-reproducible)
+type randSource struct{}
+
+func (randSource) Intn(n int) int {
+	return rand.Intn(n)
+}
+
+// keyStream expands HMAC-SHA256(key, counter || input) into a deterministic
+// sequence of numbers for a single input value
+type keyStream struct {
+	mac     hash.Hash
+	input   string
+	counter uint32
+	buf     []byte
+}
+
+func newKeyStream(key []byte, input string) *keyStream {
+	return &keyStream{
+		mac:   hmac.New(sha256.New, key),
+		input: input,
+	}
+}
+
+// Intn draws uniformly from [0, n): words below 2^32 mod n are rejected, as
+// reducing them would favour the low numbers
+func (ks *keyStream) Intn(n int) int {
+	bound := uint32(n)
+	threshold := -bound % bound
+	for {
+		if v := ks.next(); v >= threshold {
+			return int(v % bound)
+		}
 	}
 }
 
+// next returns the following 32 bits of the stream
+func (ks *keyStream) next() uint32 {
+	if len(ks.buf) < 4 {
+		var ctr [4]byte
+		binary.BigEndian.PutUint32(ctr[:], ks.counter)
+		ks.counter++
+
+		ks.mac.Reset()
+		ks.mac.Write(ctr[:])
+		ks.mac.Write([]byte(ks.input))
+		ks.buf = ks.mac.Sum(ks.buf[:0])
+	}
+
+	v := binary.BigEndian.Uint32(ks.buf[:4])
+	ks.buf = ks.buf[4:]
+	return v
+}
+
 var masking = NewMaskingService()
 
-func (ms *MaskingService) maskValue(input string) string {
+func (ms *MaskingService) maskValue(input string) (string, error) {
+	if input == "" {
+		return "", nil // nothing to substitute; not worth a cache entry
+	}
+	return ms.cache.loadOrStore(input, func() (string, error) { return ms.token(input) })
+}
+
+// token returns the vault's token for input, or a new substitution that is
+// added to the vault. Unique services draw again while the substitution
+// belongs to another input; keyed ones continue the input's key stream, but
+// which draw is free depends on the inputs masked before, so keyed unique
+// substitutions only repeat for the same inputs in the same order.
+func (ms *MaskingService) token(input string) (string, error) {
+	if ms.vault != nil {
+		token, ok, err := ms.vault.get(input)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			if ms.unique != nil {
+				free, err := ms.unique.claim(token, input)
+				if err != nil {
+					return "", err
+				}
+				if !free {
+					return "", fmt.Errorf("vault domain '%s' gives two values the same token; it was filled without unique", ms.domain)
+				}
+			}
+			return token, nil
+		}
+	}
+
+	var src intSource = randSource{}
+	if ms.key != nil {
+		src = newKeyStream(ms.key, input)
+	}
+
+	token := ms.substitute(input, src)
+	for draws := 1; ms.unique != nil; draws++ {
+		free, err := ms.claim(token, input)
+		if err != nil {
+			return "", err
+		}
+		if free {
+			break
+		}
+		if token, err = ms.redraw(input, token, src, draws); err != nil {
+			return "", err
+		}
+	}
+
+	ms.changes.add(input, token)
+	if ms.vault != nil {
+		return token, ms.vault.put(input, token)
+	}
+	return token, nil
+}
 
-	ms.rwMutex.RLock()
-	if masked, exists := ms.mapMask[input]; exists {
-		ms.rwMutex.RUnlock()
-		return masked
+// claim takes token for input unless another input has it, in this run or
+// in the vault
+func (ms *MaskingService) claim(token, input string) (bool, error) {
+	if ms.vault != nil {
+		taken, err := ms.vault.takenByOther(token, input)
+		if err != nil || taken {
+			return false, err
+		}
 	}
-	ms.rwMutex.RUnlock()
+	return ms.unique.claim(token, input)
+}
 
+// substitute draws a replacement from src for every character of input
+// outside the preserved classes
+func (ms *MaskingService) substitute(input string, src intSource) string {
 	var result []rune
 	for _, ch := range input {
-		if ch >= 'a' && ch <= 'z' {
-			result = append(result, rune(rand.Intn(26)+'a'))
-		} else if ch >= 'A' && ch <= 'Z' {
-			result = append(result, rune(rand.Intn(26)+'A'))
-		} else {
+		class, pool, ok := classifyRune(ch)
+		if !ok || ms.preserve[class] {
 			result = append(result, ch)
+			continue
 		}
+		result = append(result, pool[src.Intn(len(pool))])
 	}
+	return string(result)
+}
 
-	ms.rwMutex.Lock()
-	ms.mapMask[input] = string(result)
-	ms.rwMutex.Unlock()
+// Mask implements Masker; it only fails when a spilled cache or the vault
+// can't be read or written
+func (ms *MaskingService) Mask(value string) (string, error) {
+	return ms.maskValue(value)
+}
 
-	return string(result)
+// Stateful reports whether a resumed run needs the substitutions made so
+// far to repeat them: the vault keeps its own and keyed ones are recomputed,
+// unless they are unique, when a redraw depends on the inputs before
+func (ms *MaskingService) Stateful() bool {
+	return ms.vault == nil && (ms.key == nil || ms.unique != nil)
+}
+
+// TrackChanges starts recording new substitutions for Changes
+func (ms *MaskingService) TrackChanges() {
+	ms.changes = newStateJournal()
 }
 
-func MaskDataParallel(data []string, colIndexes []int) []string {
-	maskedSlice := make([]string, len(colIndexes))
+// Changes returns the substitutions made since the last call
+func (ms *MaskingService) Changes() map[string]string {
+	return ms.changes.take()
+}
 
-	for i, colIndex := range colIndexes {
-		if colIndex < len(data) {
-			maskedSlice[i] = masking.maskValue(data[colIndex])
+// Restore seeds the substitution cache with the Changes of an earlier run,
+// and for unique services claims the substitutions again
+func (ms *MaskingService) Restore(state map[string]string) error {
+	for input, masked := range state {
+		if ms.unique != nil {
+			free, err := ms.unique.claim(masked, input)
+			if err != nil {
+				return fmt.Errorf("restoring masking state: %w", err)
+			}
+			if !free {
+				return fmt.Errorf("restoring masking state: two values have the same substitution in domain '%s'", ms.domain)
+			}
+		}
+		if _, err := ms.cache.loadOrStore(input, func() (string, error) { return masked, nil }); err != nil {
+			return fmt.Errorf("restoring masking cache: %w", err)
 		}
 	}
-
-	return maskedSlice
+	return nil
 }
 
-// MaskBatchParallel processes multiple rows in a batch for better performance
-func MaskBatchParallel(batch [][]string, colIndexes []int) [][]string {
-	result := make([][]string, len(batch))
+// maskColumn masks rows start to end of column col.Index of batch into out,
+// stopping at the first error. Nulls stay null when col.KeepNulls is set and
+// are otherwise masked as empty strings; the null strategy turns every value
+// into a null. Nulls in nested columns always stay null, so records keep
+// their shape.
+func maskColumn(batch Batch, col ColumnMasker, start, end int, out *ColumnVector) error {
+	in := batch.Columns[col.Index]
+	_, toNull := col.Masker.(nullMasker)
+	keepNulls := col.KeepNulls || in.Levels != nil
+
+	var related *ColumnVector
+	rm, byRow := col.Masker.(rowMasker)
+	if byRow && rm.relatedColumn() >= 0 {
+		related = batch.Columns[rm.relatedColumn()]
+	}
 
-	// Process each row in the batch
-	for i, row := range batch {
-		if row == nil {
+	row := start
+	start, end = in.slots(start, end)
+	for i := start; i < end; i++ {
+		if toNull || (keepNulls && in.IsNull(i)) {
+			out.Nulls[i] = true
 			continue
 		}
 
-		// Create a copy of the row
-		maskedRow := make([]string, len(row))
-		copy(maskedRow, row)
+		var masked string
+		var err error
+		if related != nil {
+			row = in.rowOf(i, row)
+		}
+		if related != nil && !related.IsNull(row) {
+			masked, err = rm.MaskRow(in.String(i), related.String(row))
+		} else { // a row without an entity is masked on its own
+			masked, err = col.Masker.Mask(in.String(i))
+		}
+		if err != nil {
+			return fmt.Errorf("row %d: %w", i, err)
+		}
+		out.Strings[i] = masked
+	}
+	return nil
+}
 
-		// Mask the specified columns
-		for _, colIndex := range colIndexes {
-			if colIndex < len(row) {
-				maskedRow[colIndex] = masking.maskValue(row[colIndex])
-			}
+// maskedBatch copies batch with the masked columns replaced by empty string
+// vectors with the same levels; the other columns are shared, not copied
+func maskedBatch(batch Batch, columns []ColumnMasker) Batch {
+	result := Batch{Seq: batch.Seq, Columns: make([]*ColumnVector, len(batch.Columns))}
+	copy(result.Columns, batch.Columns)
+	for _, col := range columns {
+		if col.Index >= len(result.Columns) {
+			continue
 		}
 
-		result[i] = maskedRow
+		in := batch.Columns[col.Index]
+		out := newStringVector(make([]string, in.Len()))
+		out.Levels = in.Levels
+		// Allocated up front so workers masking different rows don't race
+		_, toNull := col.Masker.(nullMasker)
+		if toNull || ((col.KeepNulls || in.Levels != nil) && in.Nulls != nil) {
+			out.Nulls = make([]bool, in.Len())
+		}
+		result.Columns[col.Index] = out
 	}
-
 	return result
 }
 
-// maskRowWorker processes a range of rows for parallel masking
-func maskRowWorker(batch [][]string, colIndexes []int, start, end int, result [][]string, wg *sync.WaitGroup) {
-	defer wg.Done()
+// MaskBatchParallel masks the selected columns of batch; columns that are not
+// masked are passed through as they are
+func MaskBatchParallel(batch Batch, columns []ColumnMasker) (Batch, error) {
+	result := maskedBatch(batch, columns)
 
-	for j := start; j < end; j++ {
-		row := batch[j]
-		if row == nil {
+	for _, col := range columns {
+		if col.Index >= len(batch.Columns) {
 			continue
 		}
-
-		// Create a copy of the row
-		maskedRow := make([]string, len(row))
-		copy(maskedRow, row)
-
-		// Mask the specified columns
-		for _, colIndex := range colIndexes {
-			if colIndex < len(row) {
-				maskedRow[colIndex] = masking.maskValue(row[colIndex])
-			}
+		if err := maskColumn(batch, col, 0, batch.Len(), result.Columns[col.Index]); err != nil {
+			return Batch{}, fmt.Errorf("column %d: %w", col.Index, err)
 		}
-
-		result[j] = maskedRow
 	}
+
+	return result, nil
 }
 
 // calculateWorkerParams calculates optimal worker parameters for batch processing
@@ -125,14 +357,16 @@ func calculateWorkerParams(batchSize int) (numWorkers, chunkSize int) {
 	return numWorkers, chunkSize
 }
 
-// MaskBatchParallelWorkers processes batch using worker goroutines for very large batches
-func MaskBatchParallelWorkers(batch [][]string, colIndexes []int) [][]string {
-	if len(batch) < 100 { // For small batches, use simple processing
-		return MaskBatchParallel(batch, colIndexes)
+// MaskBatchParallelWorkers processes batch using worker goroutines for very
+// large batches; each worker masks a range of rows of every selected column
+func MaskBatchParallelWorkers(batch Batch, columns []ColumnMasker) (Batch, error) {
+	if batch.Len() < 100 { // For small batches, use simple processing
+		return MaskBatchParallel(batch, columns)
 	}
 
-	numWorkers, chunkSize := calculateWorkerParams(len(batch))
-	result := make([][]string, len(batch))
+	result := maskedBatch(batch, columns)
+	numWorkers, chunkSize := calculateWorkerParams(batch.Len())
+	errs := make([]error, numWorkers)
 	var wg sync.WaitGroup
 
 	for i := 0; i < numWorkers; i++ {
@@ -141,12 +375,28 @@ func MaskBatchParallelWorkers(batch [][]string, colIndexes []int) [][]string {
 		start := i * chunkSize
 		end := start + chunkSize
 		if i == numWorkers-1 { // Last worker handles remainder
-			end = len(batch)
+			end = batch.Len()
 		}
 
-		go maskRowWorker(batch, colIndexes, start, end, result, &wg)
+		go func(i int) {
+			defer wg.Done()
+			for _, col := range columns {
+				if col.Index >= len(batch.Columns) {
+					continue
+				}
+				if err := maskColumn(batch, col, start, end, result.Columns[col.Index]); err != nil {
+					errs[i] = fmt.Errorf("column %d: %w", col.Index, err)
+					return
+				}
+			}
+		}(i)
 	}
 
 	wg.Wait()
-	return result
+	for _, err := range errs {
+		if err != nil {
+			return Batch{}, err
+		}
+	}
+	return result, nil
 }
@@ -384,8 +384,10 @@ func (cl *CustomLogger) GetMetrics() LogMetrics {
 	}
 }
 
-// LogFinalSummary logs a final summary of the processing
-func (cl *CustomLogger) LogFinalSummary() {
+// LogFinalSummary logs a final summary of the processing; status is
+// "completed", "interrupted" or "failed". Extra fields (e.g. cache
+// statistics) are added to the entry.
+func (cl *CustomLogger) LogFinalSummary(status string, extra ...map[string]interface{}) {
 	metrics := cl.GetMetrics()
 	totalDuration := time.Since(cl.startTime)
 
@@ -396,7 +398,20 @@ func (cl *CustomLogger) LogFinalSummary() {
 		"avg_processing_rate": fmt.Sprintf("%.0f rows/sec", metrics.ProcessingRate),
 		"error_count":         metrics.ErrorCount,
 		"warning_count":       metrics.WarningCount,
+		"status":              status,
+	}
+	for _, f := range extra {
+		for k, v := range f {
+			fields[k] = v
+		}
 	}
 
-	cl.log(INFO, "Processing completed successfully", fields)
+	switch status {
+	case "completed":
+		cl.log(INFO, "Processing completed successfully", fields)
+	case "interrupted":
+		cl.log(WARN, "Processing interrupted", fields)
+	default:
+		cl.log(ERROR, "Processing "+status, fields)
+	}
 }
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/xitongsys/parquet-go/parquet"
+)
+
+// logicalKind is a parquet logical type with its own text form
+type logicalKind int
+
+const (
+	logicalDate      logicalKind = iota + 1 // INT32 days since 1970-01-01
+	logicalTime                             // INT32 or INT64 time of day
+	logicalTimestamp                        // INT64 since the epoch
+	logicalInt96                            // legacy INT96 timestamp (Impala, Spark)
+	logicalDecimal                          // scaled integer in any physical type
+	logicalUUID                             // 16-byte FIXED_LEN_BYTE_ARRAY
+)
+
+func (k logicalKind) String() string {
+	switch k {
+	case logicalDate:
+		return "DATE"
+	case logicalTime:
+		return "TIME"
+	case logicalTimestamp:
+		return "TIMESTAMP"
+	case logicalInt96:
+		return "INT96 timestamp"
+	case logicalDecimal:
+		return "DECIMAL"
+	case logicalUUID:
+		return "UUID"
+	}
+	return "none"
+}
+
+const (
+	dateLayout          = "2006-01-02"
+	timeLayout          = "15:04:05.999999999"
+	localDateTimeLayout = "2006-01-02T15:04:05.999999999"
+)
+
+// julianUnixEpoch is the Julian day number of 1970-01-01, the day count INT96
+// timestamps are based on
+const julianUnixEpoch = 2440588
+
+// logicalFormat renders the values of a column with a logical type as text
+// and parses that text back, so masked values can be written to parquet in
+// the column's type. Timestamps adjusted to UTC are instants and are rendered
+// in loc as RFC 3339; the others are wall-clock times without an offset.
+type logicalFormat struct {
+	kind     logicalKind
+	physical parquet.Type
+	unit     time.Duration // resolution of times and timestamps
+	adjusted bool          // timestamp is an instant (UTC) rather than a wall-clock time
+	scale    int           // decimal digits after the point
+	size     int           // length of FIXED_LEN_BYTE_ARRAY values
+	loc      *time.Location
+}
+
+// newLogicalFormat describes how to render el, or returns nil for columns
+// that are rendered as stored (strings, plain numbers, booleans). The logical
+// type annotation takes precedence over the legacy converted type.
+func newLogicalFormat(el *parquet.SchemaElement, loc *time.Location) *logicalFormat {
+	if loc == nil {
+		loc = time.UTC
+	}
+	f := &logicalFormat{physical: el.GetType(), size: int(el.GetTypeLength()), loc: loc}
+
+	if lt := el.LogicalType; lt != nil {
+		switch {
+		case lt.IsSetDATE():
+			f.kind = logicalDate
+		case lt.IsSetTIME():
+			f.kind, f.unit = logicalTime, timeUnitDuration(lt.TIME.GetUnit())
+		case lt.IsSetTIMESTAMP():
+			f.kind, f.unit = logicalTimestamp, timeUnitDuration(lt.TIMESTAMP.GetUnit())
+			f.adjusted = lt.TIMESTAMP.GetIsAdjustedToUTC()
+		case lt.IsSetDECIMAL():
+			f.kind, f.scale = logicalDecimal, int(lt.DECIMAL.GetScale())
+		case lt.IsSetUUID():
+			f.kind = logicalUUID
+		}
+	}
+
+	if f.kind == 0 && el.ConvertedType != nil {
+		switch el.GetConvertedType() {
+		case parquet.ConvertedType_DATE:
+			f.kind = logicalDate
+		case parquet.ConvertedType_TIME_MILLIS:
+			f.kind, f.unit = logicalTime, time.Millisecond
+		case parquet.ConvertedType_TIME_MICROS:
+			f.kind, f.unit = logicalTime, time.Microsecond
+		case parquet.ConvertedType_TIMESTAMP_MILLIS:
+			f.kind, f.unit, f.adjusted = logicalTimestamp, time.Millisecond, true
+		case parquet.ConvertedType_TIMESTAMP_MICROS:
+			f.kind, f.unit, f.adjusted = logicalTimestamp, time.Microsecond, true
+		case parquet.ConvertedType_DECIMAL:
+			f.kind, f.scale = logicalDecimal, int(el.GetScale())
+		}
+	}
+
+	if f.kind == 0 && f.physical == parquet.Type_INT96 {
+		f.kind, f.adjusted = logicalInt96, true
+	}
+
+	// Annotations on physical types they don't apply to are ignored
+	switch {
+	case f.kind == 0,
+		f.kind == logicalDate && f.physical != parquet.Type_INT32,
+		f.kind == logicalTimestamp && f.physical != parquet.Type_INT64,
+		f.kind == logicalUUID && (f.physical != parquet.Type_FIXED_LEN_BYTE_ARRAY || f.size != 16):
+		return nil
+	}
+	return f
+}
+
+func timeUnitDuration(unit *parquet.TimeUnit) time.Duration {
+	switch {
+	case unit.IsSetNANOS():
+		return time.Nanosecond
+	case unit.IsSetMICROS():
+		return time.Microsecond
+	default:
+		return time.Millisecond
+	}
+}
+
+// render formats a value of the column's physical Go type. Values that don't
+// fit the logical type (e.g. a short INT96) are rendered as stored.
+func (f *logicalFormat) render(value interface{}) string {
+	switch f.kind {
+	case logicalDate:
+		if days, ok := value.(int32); ok {
+			return time.Unix(int64(days)*86400, 0).UTC().Format(dateLayout)
+		}
+	case logicalTime:
+		if n, ok := integerValue(value); ok {
+			return time.Unix(0, 0).UTC().Add(time.Duration(n) * f.unit).Format(timeLayout)
+		}
+	case logicalTimestamp:
+		if n, ok := value.(int64); ok {
+			return f.formatTime(unixTime(n, f.unit))
+		}
+	case logicalInt96:
+		if s, ok := value.(string); ok && len(s) == 12 {
+			nanos := int64(binary.LittleEndian.Uint64([]byte(s[:8])))
+			days := int64(binary.LittleEndian.Uint32([]byte(s[8:])))
+			return f.formatTime(time.Unix((days-julianUnixEpoch)*86400, nanos))
+		}
+	case logicalDecimal:
+		if unscaled, ok := decimalValue(value); ok {
+			return formatDecimal(unscaled, f.scale)
+		}
+	case logicalUUID:
+		if s, ok := value.(string); ok && len(s) == 16 {
+			h := hex.EncodeToString([]byte(s))
+			return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+		}
+	}
+	return fmt.Sprint(value)
+}
+
+func (f *logicalFormat) formatTime(t time.Time) string {
+	if f.adjusted {
+		return t.In(f.loc).Format(time.RFC3339Nano)
+	}
+	return t.UTC().Format(localDateTimeLayout)
+}
+
+func (f *logicalFormat) parseTime(s string) (time.Time, error) {
+	if f.adjusted {
+		return time.Parse(time.RFC3339Nano, s)
+	}
+	return time.Parse(localDateTimeLayout, s)
+}
+
+// parse is the inverse of render: it converts text to the column's physical
+// Go type
+func (f *logicalFormat) parse(s string) (interface{}, error) {
+	switch f.kind {
+	case logicalDate:
+		t, err := time.Parse(dateLayout, s)
+		if err != nil {
+			return nil, err
+		}
+		return int32(t.Unix() / 86400), nil
+
+	case logicalTime:
+		t, err := time.Parse(timeLayout, s)
+		if err != nil {
+			return nil, err
+		}
+		n := t.Sub(time.Date(0, 1, 1, 0, 0, 0, 0, time.UTC)) / f.unit
+		if f.physical == parquet.Type_INT32 {
+			return int32(n), nil
+		}
+		return int64(n), nil
+
+	case logicalTimestamp:
+		t, err := f.parseTime(s)
+		if err != nil {
+			return nil, err
+		}
+		switch f.unit {
+		case time.Nanosecond:
+			return t.UnixNano(), nil
+		case time.Microsecond:
+			return t.UnixMicro(), nil
+		default:
+			return t.UnixMilli(), nil
+		}
+
+	case logicalInt96:
+		t, err := f.parseTime(s)
+		if err != nil {
+			return nil, err
+		}
+		secs := t.Unix()
+		days := secs / 86400
+		if secs%86400 < 0 {
+			days--
+		}
+		nanos := (secs-days*86400)*int64(time.Second) + int64(t.Nanosecond())
+
+		b := make([]byte, 12)
+		binary.LittleEndian.PutUint64(b[:8], uint64(nanos))
+		binary.LittleEndian.PutUint32(b[8:], uint32(days+julianUnixEpoch))
+		return string(b), nil
+
+	case logicalDecimal:
+		unscaled, err := parseDecimal(s, f.scale)
+		if err != nil {
+			return nil, err
+		}
+		return decimalPhysical(unscaled, f.physical, f.size)
+
+	case logicalUUID:
+		b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+		if err != nil || len(b) != 16 {
+			return nil, fmt.Errorf("invalid UUID %q", s)
+		}
+		return string(b), nil
+	}
+	return nil, fmt.Errorf("unknown logical type")
+}
+
+func unixTime(n int64, unit time.Duration) time.Time {
+	switch unit {
+	case time.Nanosecond:
+		return time.Unix(0, n)
+	case time.Microsecond:
+		return time.UnixMicro(n)
+	default:
+		return time.UnixMilli(n)
+	}
+}
+
+func integerValue(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	}
+	return 0, false
+}
+
+// decimalValue reads the unscaled value of a decimal: an INT32 or INT64, or
+// a big-endian two's complement byte array
+func decimalValue(value interface{}) (*big.Int, bool) {
+	if n, ok := integerValue(value); ok {
+		return big.NewInt(n), true
+	}
+
+	s, ok := value.(string)
+	if !ok || len(s) == 0 {
+		return nil, false
+	}
+	unscaled := new(big.Int).SetBytes([]byte(s))
+	if s[0]&0x80 != 0 {
+		unscaled.Sub(unscaled, new(big.Int).Lsh(big.NewInt(1), uint(8*len(s))))
+	}
+	return unscaled, true
+}
+
+// formatDecimal places the decimal point scale digits from the right
+func formatDecimal(unscaled *big.Int, scale int) string {
+	digits := new(big.Int).Abs(unscaled).String()
+	sign := ""
+	if unscaled.Sign() < 0 {
+		sign = "-"
+	}
+	if scale <= 0 {
+		return sign + digits + strings.Repeat("0", -scale)
+	}
+	if len(digits) <= scale {
+		digits = strings.Repeat("0", scale-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-scale] + "." + digits[len(digits)-scale:]
+}
+
+// parseDecimal reads a decimal with at most scale fractional digits as its
+// unscaled value
+func parseDecimal(s string, scale int) (*big.Int, error) {
+	intPart, fracPart, _ := strings.Cut(s, ".")
+	if len(fracPart) > scale {
+		return nil, fmt.Errorf("decimal %q has more than %d digits after the point", s, scale)
+	}
+
+	digits := intPart + fracPart + strings.Repeat("0", scale-len(fracPart))
+	unscaled, ok := new(big.Int).SetString(digits, 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid decimal %q", s)
+	}
+	return unscaled, nil
+}
+
+// decimalPhysical stores an unscaled decimal in its physical type
+func decimalPhysical(unscaled *big.Int, physical parquet.Type, size int) (interface{}, error) {
+	switch physical {
+	case parquet.Type_INT32:
+		if !unscaled.IsInt64() || unscaled.Int64() != int64(int32(unscaled.Int64())) {
+			return nil, fmt.Errorf("decimal %s does not fit INT32", unscaled)
+		}
+		return int32(unscaled.Int64()), nil
+	case parquet.Type_INT64:
+		if !unscaled.IsInt64() {
+			return nil, fmt.Errorf("decimal %s does not fit INT64", unscaled)
+		}
+		return unscaled.Int64(), nil
+	}
+
+	// Two's complement, big-endian, sign-extended to size bytes (or the
+	// minimal length for BYTE_ARRAY)
+	n := size
+	if physical != parquet.Type_FIXED_LEN_BYTE_ARRAY {
+		n = unscaled.BitLen()/8 + 1
+	}
+	limit := new(big.Int).Lsh(big.NewInt(1), uint(8*n-1))
+	if unscaled.Cmp(limit) >= 0 || unscaled.Cmp(new(big.Int).Neg(limit)) < 0 {
+		return nil, fmt.Errorf("decimal %s does not fit %d bytes", unscaled, n)
+	}
+
+	value := new(big.Int).Set(unscaled)
+	if value.Sign() < 0 {
+		value.Add(value, new(big.Int).Lsh(limit, 1))
+	}
+	out := make([]byte, n)
+	value.FillBytes(out)
+	return string(out), nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xitongsys/parquet-go/parquet"
+)
+
+func timeUnit(unit time.Duration) *parquet.TimeUnit {
+	switch unit {
+	case time.Nanosecond:
+		return &parquet.TimeUnit{NANOS: parquet.NewNanoSeconds()}
+	case time.Microsecond:
+		return &parquet.TimeUnit{MICROS: parquet.NewMicroSeconds()}
+	default:
+		return &parquet.TimeUnit{MILLIS: parquet.NewMilliSeconds()}
+	}
+}
+
+func timeElement(physical parquet.Type, unit time.Duration) *parquet.SchemaElement {
+	return &parquet.SchemaElement{
+		Type:        parquet.TypePtr(physical),
+		LogicalType: &parquet.LogicalType{TIME: &parquet.TimeType{Unit: timeUnit(unit)}},
+	}
+}
+
+func timestampElement(unit time.Duration, adjusted bool) *parquet.SchemaElement {
+	return &parquet.SchemaElement{
+		Type:        parquet.TypePtr(parquet.Type_INT64),
+		LogicalType: &parquet.LogicalType{TIMESTAMP: &parquet.TimestampType{IsAdjustedToUTC: adjusted, Unit: timeUnit(unit)}},
+	}
+}
+
+func decimalElement(physical parquet.Type, size, scale int32) *parquet.SchemaElement {
+	return &parquet.SchemaElement{
+		Type:          parquet.TypePtr(physical),
+		TypeLength:    &size,
+		ConvertedType: parquet.ConvertedTypePtr(parquet.ConvertedType_DECIMAL),
+		Scale:         &scale,
+	}
+}
+
+// int96 builds an INT96 timestamp from days since the epoch and nanoseconds
+// into the day, independently of the code under test
+func int96(days uint32, nanos uint64) string {
+	b := make([]byte, 12)
+	for i := 0; i < 8; i++ {
+		b[i] = byte(nanos >> (8 * i))
+	}
+	days += julianUnixEpoch
+	for i := 0; i < 4; i++ {
+		b[8+i] = byte(days >> (8 * i))
+	}
+	return string(b)
+}
+
+func fromHex(s string) string {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
+// TestLogicalFormatGolden renders a stored value of each logical type, checks
+// the text against its known form and parses it back to the same value
+func TestLogicalFormatGolden(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("time zone database unavailable:", err)
+	}
+
+	date := &parquet.SchemaElement{
+		Type:        parquet.TypePtr(parquet.Type_INT32),
+		LogicalType: &parquet.LogicalType{DATE: parquet.NewDateType()},
+	}
+	legacyDate := &parquet.SchemaElement{
+		Type:          parquet.TypePtr(parquet.Type_INT32),
+		ConvertedType: parquet.ConvertedTypePtr(parquet.ConvertedType_DATE),
+	}
+	legacyMillis := &parquet.SchemaElement{
+		Type:          parquet.TypePtr(parquet.Type_INT64),
+		ConvertedType: parquet.ConvertedTypePtr(parquet.ConvertedType_TIMESTAMP_MILLIS),
+	}
+	uuidLength := int32(16)
+	uuid := &parquet.SchemaElement{
+		Type:        parquet.TypePtr(parquet.Type_FIXED_LEN_BYTE_ARRAY),
+		TypeLength:  &uuidLength,
+		LogicalType: &parquet.LogicalType{UUID: parquet.NewUUIDType()},
+	}
+
+	tests := []struct {
+		name   string
+		el     *parquet.SchemaElement
+		loc    *time.Location
+		stored interface{}
+		text   string
+	}{
+		{"date", date, nil, int32(19000), "2022-01-08"},
+		{"date before epoch", date, nil, int32(-1), "1969-12-31"},
+		{"converted date", legacyDate, nil, int32(0), "1970-01-01"},
+		{"time millis", timeElement(parquet.Type_INT32, time.Millisecond), nil, int32(45296789), "12:34:56.789"},
+		{"time micros", timeElement(parquet.Type_INT64, time.Microsecond), nil, int64(45296789012), "12:34:56.789012"},
+		{"time nanos", timeElement(parquet.Type_INT64, time.Nanosecond), nil, int64(45296789012345), "12:34:56.789012345"},
+		{"timestamp millis", timestampElement(time.Millisecond, true), nil, int64(1700000000123), "2023-11-14T22:13:20.123Z"},
+		{"timestamp micros in zone", timestampElement(time.Microsecond, true), berlin, int64(1700000000123456), "2023-11-14T23:13:20.123456+01:00"},
+		{"timestamp nanos local", timestampElement(time.Nanosecond, false), nil, int64(1700000000123456789), "2023-11-14T22:13:20.123456789"},
+		{"converted timestamp millis", legacyMillis, nil, int64(-1), "1969-12-31T23:59:59.999Z"},
+		{"int96", &parquet.SchemaElement{Type: parquet.TypePtr(parquet.Type_INT96)}, nil, int96(19675, 80000500000000), "2023-11-14T22:13:20.5Z"},
+		{"decimal int32", decimalElement(parquet.Type_INT32, 0, 2), nil, int32(-12345), "-123.45"},
+		{"decimal int64", decimalElement(parquet.Type_INT64, 0, 4), nil, int64(5), "0.0005"},
+		{"decimal fixed", decimalElement(parquet.Type_FIXED_LEN_BYTE_ARRAY, 8, 3), nil, fromHex("ffffffffffed2979"), "-1234.567"},
+		{"decimal byte array", decimalElement(parquet.Type_BYTE_ARRAY, 0, 2), nil, fromHex("00ab54a98ceb1f0ad2"), "123456789012345678.90"},
+		{"uuid", uuid, nil, fromHex("123456789abcdef0123456789abcdef0"), "12345678-9abc-def0-1234-56789abcdef0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newLogicalFormat(tt.el, tt.loc)
+			if f == nil {
+				t.Fatal("no logical format")
+			}
+			if got := f.render(tt.stored); got != tt.text {
+				t.Errorf("render = %q, want %q", got, tt.text)
+			}
+			back, err := f.parse(tt.text)
+			if err != nil {
+				t.Fatalf("parse(%q): %v", tt.text, err)
+			}
+			if !reflect.DeepEqual(back, tt.stored) {
+				t.Errorf("parse(%q) = %#v, want %#v", tt.text, back, tt.stored)
+			}
+		})
+	}
+}
+
+type logicalRow struct {
+	Name     string `parquet:"name=name, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Day      int32  `parquet:"name=day, type=INT32, convertedtype=DATE"`
+	TimeMs   int32  `parquet:"name=time_ms, type=INT32, logicaltype=TIME, logicaltype.isadjustedtoutc=false, logicaltype.unit=MILLIS"`
+	TimeUs   int64  `parquet:"name=time_us, type=INT64, logicaltype=TIME, logicaltype.isadjustedtoutc=false, logicaltype.unit=MICROS"`
+	TsMillis int64  `parquet:"name=ts_millis, type=INT64, logicaltype=TIMESTAMP, logicaltype.isadjustedtoutc=true, logicaltype.unit=MILLIS"`
+	TsMicros int64  `parquet:"name=ts_micros, type=INT64, logicaltype=TIMESTAMP, logicaltype.isadjustedtoutc=true, logicaltype.unit=MICROS"`
+	TsNanos  int64  `parquet:"name=ts_nanos, type=INT64, logicaltype=TIMESTAMP, logicaltype.isadjustedtoutc=false, logicaltype.unit=NANOS"`
+	Ts96     string `parquet:"name=ts96, type=INT96"`
+	Dec32    int32  `parquet:"name=dec32, type=INT32, convertedtype=DECIMAL, scale=2, precision=9"`
+	Dec64    int64  `parquet:"name=dec64, type=INT64, convertedtype=DECIMAL, scale=4, precision=18"`
+	DecFixed string `parquet:"name=dec_fixed, type=FIXED_LEN_BYTE_ARRAY, length=8, convertedtype=DECIMAL, scale=3, precision=18"`
+	ID       string `parquet:"name=id, type=FIXED_LEN_BYTE_ARRAY, length=16, logicaltype=UUID"`
+}
+
+// logicalGolden is the CSV rendering of logicalRows, without the name column
+var logicalGolden = [][]string{
+	{"2022-01-08", "12:34:56.789", "12:34:56.789012", "2023-11-14T22:13:20.123Z", "2023-11-14T22:13:20.123456Z",
+		"2023-11-14T22:13:20.123456789", "2023-11-14T22:13:20.5Z", "-123.45", "0.0005", "-1234.567",
+		"12345678-9abc-def0-1234-56789abcdef0"},
+	{"1969-12-31", "00:00:00", "23:59:59.999999", "1969-12-31T23:59:59.999Z", "1970-01-01T00:00:00Z",
+		"1970-01-01T00:00:00.000000001", "1970-01-01T00:00:00Z", "0.01", "-0.0001", "0.000",
+		"00000000-0000-0000-0000-000000000000"},
+}
+
+func logicalRows() []interface{} {
+	return []interface{}{
+		&logicalRow{"alice", 19000, 45296789, 45296789012, 1700000000123, 1700000000123456, 1700000000123456789,
+			int96(19675, 80000500000000), -12345, 5, fromHex("ffffffffffed2979"), fromHex("123456789abcdef0123456789abcdef0")},
+		&logicalRow{"bob", -1, 0, 86399999999, -1, 0, 1,
+			int96(0, 0), 1, -1, strings.Repeat("\x00", 8), strings.Repeat("\x00", 16)},
+	}
+}
+
+// logicalCSV masks the name column of input to CSV and returns the other
+// columns
+func logicalCSV(t *testing.T, input string) [][]string {
+	t.Helper()
+	out := runJob(t, &AppConfig{
+		InputPath:     input,
+		InputFormat:   "parquet",
+		OutputFile:    testPath(t, "output.csv"),
+		OutputFormat:  "csv",
+		ColumnsToMask: []string{"name"},
+		MaskKey:       []byte("secret"),
+	})
+	records, err := csv.NewReader(strings.NewReader(string(out))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range records {
+		records[i] = records[i][1:]
+	}
+	return records[1:]
+}
+
+// TestLogicalTypesRoundTrip reads each logical type from parquet, writes the
+// rendered text back into the column's type and checks it reads the same
+func TestLogicalTypesRoundTrip(t *testing.T) {
+	input := testPath(t, "input.parquet")
+	writeParquetFixture(t, input, new(logicalRow), logicalRows(), 0)
+
+	rendered := logicalCSV(t, input)
+	if !reflect.DeepEqual(rendered, logicalGolden) {
+		t.Fatalf("rendered\n%q\nwant\n%q", rendered, logicalGolden)
+	}
+
+	// Redacting every typed column to its own text forces each value through
+	// parsing into the physical type
+	schema, err := readParquetSchema(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for row, values := range logicalGolden {
+		var policy strings.Builder
+		policy.WriteString("columns:\n")
+		for i, value := range values {
+			fmt.Fprintf(&policy, "  - column: %s\n    strategy: redact\n    replacement: %q\n", schema.Columns[i+1].Name, value)
+		}
+		policyPath := testPath(t, "policy.yaml")
+		if err := os.WriteFile(policyPath, []byte(policy.String()), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		output := testPath(t, "output.parquet")
+		runJob(t, &AppConfig{
+			InputPath:    input,
+			InputFormat:  "parquet",
+			OutputFile:   output,
+			OutputFormat: "parquet",
+			PolicyPath:   policyPath,
+		})
+
+		for _, got := range logicalCSV(t, output) {
+			if !reflect.DeepEqual(got, values) {
+				t.Errorf("row %d written back reads\n%q\nwant\n%q", row+1, got, values)
+			}
+		}
+	}
+}
@@ -1,13 +1,15 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
-	"strconv"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -17,7 +19,9 @@ func timer(name string, quiet bool) func() {
 	start := time.Now()
 	return func() {
 		duration := time.Since(start)
-		logger.LogTiming(name, duration)
+		if logger != nil {
+			logger.LogTiming(name, duration)
+		}
 		if !quiet {
 			fmt.Printf("%s took %v\n", name, duration)
 		}
@@ -52,225 +56,906 @@ func initImprovedLogger(quiet, verbose, jsonLogs bool) error {
 	return nil
 }
 
-// parseColumns parses a comma-separated string of column indexes
-func parseColumns(columnStr string) ([]int, error) {
-	if columnStr == "" {
-		return []int{3}, nil // Default to column 3
-	}
-
-	parts := strings.Split(columnStr, ",")
-	columns := make([]int, 0, len(parts))
+// maskKeyEnvVar is consulted when no key is given on the command line
+const maskKeyEnvVar = "MASKING_KEY"
 
-	for _, part := range parts {
-		part = strings.TrimSpace(part)
-		if part == "" {
-			continue
-		}
+// loadMaskingKey resolves the secret used for keyed masking. The -mask_key
+// flag wins over -mask_key_file, which wins over the environment variable.
+// An empty result means keyed masking is disabled.
+func loadMaskingKey(flagKey, keyFile string) ([]byte, string, error) {
+	if flagKey != "" {
+		return []byte(flagKey), "flag", nil
+	}
 
-		col, err := strconv.Atoi(part)
+	if keyFile != "" {
+		data, err := os.ReadFile(keyFile)
 		if err != nil {
-			return nil, fmt.Errorf("invalid column index '%s': %w", part, err)
+			return nil, "", fmt.Errorf("failed to read key file %s: %w", keyFile, err)
 		}
-
-		if col < 0 {
-			return nil, fmt.Errorf("column index must be non-negative, got %d", col)
+		key := strings.TrimRight(string(data), "\r\n")
+		if key == "" {
+			return nil, "", fmt.Errorf("key file %s is empty", keyFile)
 		}
+		return []byte(key), "file", nil
+	}
+
+	if envKey := os.Getenv(maskKeyEnvVar); envKey != "" {
+		return []byte(envKey), "env", nil
+	}
+
+	return nil, "", nil
+}
+
+// maskingFlags holds the key and FPE flags shared by the mask and unmask commands
+type maskingFlags struct {
+	maskKey     *string
+	maskKeyFile *string
+	fpeMode     *string
+	fpeAlphabet *string
+	fpeTweak    *string
+	fpeShort    *string
+}
 
-		columns = append(columns, col)
+func registerMaskingFlags(fs *flag.FlagSet, defaultFPEMode string) *maskingFlags {
+	return &maskingFlags{
+		maskKey:     fs.String("mask_key", "", "secret for keyed (reproducible) masking; falls back to -mask_key_file and $"+maskKeyEnvVar),
+		maskKeyFile: fs.String("mask_key_file", "", "path to a file containing the secret for keyed masking"),
+		fpeMode:     fs.String("fpe", defaultFPEMode, "format-preserving encryption mode: ff1 or ff3-1 (requires a masking key)"),
+		fpeAlphabet: fs.String("fpe_alphabet", "alphanumeric", "FPE alphabet: "+strings.Join(fpeAlphabetNames(), ", ")),
+		fpeTweak:    fs.String("fpe_tweak", "", "hex-encoded FPE tweak (FF3-1 requires exactly 7 bytes; empty means all zeros)"),
+		fpeShort:    fs.String("fpe_short_values", fpeShortError, "values with too few alphabet characters for FPE: error stops the run, substitute masks them one-way (unmask writes them as null)"),
+	}
+}
+
+// resolve loads the key and validates the FPE settings
+func (mf *maskingFlags) resolve() (key []byte, keySource string, mode FPEMode, tweak []byte, err error) {
+	key, keySource, err = loadMaskingKey(*mf.maskKey, *mf.maskKeyFile)
+	if err != nil {
+		return nil, "", "", nil, errors.New("error loading masking key: " + err.Error())
 	}
 
-	if len(columns) == 0 {
-		return []int{3}, nil // Default to column 3
+	if *mf.fpeShort != fpeShortError && *mf.fpeShort != fpeShortSubstitute {
+		return nil, "", "", nil, fmt.Errorf("unknown -fpe_short_values '%s' (expected %s or %s)", *mf.fpeShort, fpeShortError, fpeShortSubstitute)
 	}
 
-	return columns, nil
+	mode = FPEMode(strings.ToLower(*mf.fpeMode))
+	if mode == "" {
+		return key, keySource, mode, nil, nil
+	}
+
+	if mode != FF1 && mode != FF31 {
+		return nil, "", "", nil, fmt.Errorf("unknown FPE mode '%s' (expected %s or %s)", *mf.fpeMode, FF1, FF31)
+	}
+	if key == nil {
+		return nil, "", "", nil, fmt.Errorf("FPE mode %s requires -mask_key, -mask_key_file or $%s", mode, maskKeyEnvVar)
+	}
+
+	tweak, err = parseFPETweak(mode, *mf.fpeTweak)
+	if err != nil {
+		return nil, "", "", nil, errors.New("error parsing FPE tweak: " + err.Error())
+	}
+
+	return key, keySource, mode, tweak, nil
 }
 
 type AppConfig struct {
-	InputPath     string
-	OutputFile    string
-	ColumnsToMask []int
-	ChunkSize     int
-	Quiet         bool
-	Verbose       bool
-	JsonLogs      bool
+	InputPath       string
+	OutputFile      string
+	ColumnsToMask   []string
+	ChunkSize       int
+	Quiet           bool
+	Verbose         bool
+	JsonLogs        bool
+	MaskKey         []byte
+	MaskKeySource   string
+	FPEMode         FPEMode
+	FPEAlphabet     string
+	FPETweak        []byte
+	FPEShortValues  string // fpeShortError or fpeShortSubstitute
+	Preserve        map[CharClass]bool
+	PolicyPath      string
+	OutputFormat    string
+	ParquetCodec    string
+	InputFormat     string
+	CSVDelimiter    rune
+	CSVHeader       string
+	CSVLazyQuotes   bool
+	Resume          bool
+	CheckpointEvery int
+	Readers         int
+	Timezone        *time.Location
+	KeepNulls       bool
+	Unique          bool
+	CSVNull         string
+	CacheMemory     int64  // bytes shared by the substitution caches; 0 is unbounded
+	CacheSpillDir   string // where evicted substitutions are kept
+	VaultPath       string
+	VaultKey        []byte
+	VaultDomain     string // domain of the -columns masker
 }
 
 func parseCommandLineArgs() (*AppConfig, error) {
 	inputPath := flag.String("input_path", "creditagreementliabledebtor.snappy.parquet", "insert path to the file to mask")
+	inputFormat := flag.String("input_format", "auto", "input format: auto (by file extension) or "+strings.Join(sourceFormatNames(), ", "))
+	csvDelimiter := flag.String("csv_delimiter", ",", "CSV input field delimiter: a single character or tab, comma, semicolon, pipe")
+	csvHeader := flag.String("csv_header", "auto", "whether the first CSV input row is a header: auto, true or false")
+	csvLazyQuotes := flag.Bool("csv_lazy_quotes", false, "accept bare and unescaped quotes inside CSV input fields")
+	timezone := flag.String("timezone", "UTC", "IANA time zone (or Local) that parquet timestamps are rendered in")
 	quiet := flag.Bool("quiet", false, "run in quiet mode (no console output)")
 	verbose := flag.Bool("verbose", false, "run in verbose mode (debug level logging)")
 	jsonLogs := flag.Bool("json", false, "output logs in JSON format")
-	columnsStr := flag.String("columns", "3", "comma-separated list of column indexes to mask (e.g., '3' or '1,3,5')")
+	columnsStr := flag.String("columns", "3", "comma-separated column indexes, names, dotted paths or globs to mask (e.g., '3', 'last_name,address.*' or '*_email')")
+	keepNulls := flag.Bool("keep_nulls", true, "leave null values null; -keep_nulls=false masks them as empty strings (with -policy, set keep_nulls in the policy file)")
+	unique := flag.Bool("unique", false, "never give two distinct values the same substitution, as key columns need (with -policy, set unique per column)")
+	csvNull := flag.String("csv_null", `\N`, "text standing for null values in CSV input and output, e.g. NULL, or empty for empty fields")
+	preserveStr := flag.String("preserve_classes", "", "comma-separated character classes to keep unmasked: "+strings.Join(charClassNames(), ", "))
+	outputPath := flag.String("output_path", "", "output file or directory; supports {input_basename}, {input_name}, {input_dir} and {ext} (default output.<ext>, or "+defaultOutputTemplate+" inside a directory)")
+	outputFormat := flag.String("output_format", "csv", "output format: "+strings.Join(sinkFormatNames(), ", ")+" (parquet keeps the source schema)")
+	parquetCodec := flag.String("parquet_codec", "", "codec for parquet output (uncompressed, snappy, gzip, lz4, zstd); default is the source codec")
+	resume := flag.Bool("resume", false, "continue from the checkpoint next to the output, skipping rows already written (csv and jsonl output)")
+	readers := flag.Int("readers", 1, "number of parallel parquet row-group readers; output keeps the input row order")
+	checkpointEvery := flag.Int("checkpoint_every", 0, "write a checkpoint every N batches so a failed or killed run can -resume (0 disables)")
+	cacheMemory := flag.String("cache_memory", "0", "memory for remembered substitutions, e.g. 512MB or 2GB; least recently used values are evicted beyond it (0 is unbounded)")
+	cacheSpillDir := flag.String("cache_spill_dir", "", "directory for an on-disk store of evicted substitutions, keeping random substitution consistent under -cache_memory")
+	vaultPath := flag.String("vault", "", "token vault file that keeps substitutions consistent across files and runs (created if missing)")
+	vaultKeyFile := flag.String("vault_key_file", "", "path to a file containing the secret the vault is encrypted with")
+	vaultDomain := flag.String("vault_domain", "default", "vault domain of the columns masked with -columns (with -policy, set domain per column)")
+	policyPath := flag.String("policy", "", "YAML or JSON file mapping columns to masking strategies (replaces -columns)")
+	maskFlags := registerMaskingFlags(flag.CommandLine, "")
 	flag.Parse()
 
+	if *policyPath != "" {
+		var conflict []string
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "columns", "fpe", "fpe_alphabet", "fpe_tweak", "fpe_short_values", "preserve_classes", "keep_nulls", "unique", "vault_domain":
+				conflict = append(conflict, "-"+f.Name)
+			}
+		})
+		if len(conflict) > 0 {
+			return nil, fmt.Errorf("-policy cannot be combined with %s; configure those in the policy file", strings.Join(conflict, ", "))
+		}
+	}
+
 	columnsToMask, err := parseColumns(*columnsStr)
 	if err != nil {
 		return nil, errors.New("error parsing columns: " + err.Error())
 	}
 
+	format := strings.ToLower(*outputFormat)
+	if _, ok := sinkFormats[format]; !ok {
+		return nil, fmt.Errorf("unknown output format '%s' (expected one of %s)", *outputFormat, strings.Join(sinkFormatNames(), ", "))
+	}
+
+	outputFile, err := resolveOutputPath(*outputPath, *inputPath, format)
+	if err != nil {
+		return nil, errors.New("error resolving output_path: " + err.Error())
+	}
+
+	if (*resume || *checkpointEvery > 0) && format == "parquet" {
+		return nil, errors.New("-resume and -checkpoint_every need csv or jsonl output; parquet output can't be appended to")
+	}
+	if *readers < 1 {
+		return nil, fmt.Errorf("readers must be at least 1, got %d", *readers)
+	}
+	if *checkpointEvery < 0 {
+		return nil, fmt.Errorf("checkpoint_every must be non-negative, got %d", *checkpointEvery)
+	}
+
+	cacheBytes, err := parseByteSize(*cacheMemory)
+	if err != nil {
+		return nil, errors.New("error parsing cache_memory: " + err.Error())
+	}
+	if *cacheSpillDir != "" && cacheBytes == 0 {
+		return nil, errors.New("-cache_spill_dir needs -cache_memory")
+	}
+
+	var vaultKey []byte
+	if *vaultPath != "" {
+		if *vaultKeyFile == "" {
+			return nil, errors.New("-vault needs -vault_key_file")
+		}
+		if vaultKey, err = loadVaultKey(*vaultKeyFile); err != nil {
+			return nil, errors.New("error loading vault key: " + err.Error())
+		}
+	}
+
+	inFormat := strings.ToLower(*inputFormat)
+	if _, ok := sourceFormats[inFormat]; !ok && inFormat != "auto" {
+		return nil, fmt.Errorf("unknown input format '%s' (expected auto or one of %s)", *inputFormat, strings.Join(sourceFormatNames(), ", "))
+	}
+
+	delimiter, err := parseDelimiter(*csvDelimiter)
+	if err != nil {
+		return nil, errors.New("error parsing csv_delimiter: " + err.Error())
+	}
+
+	loc, err := time.LoadLocation(*timezone)
+	if err != nil {
+		return nil, errors.New("error parsing timezone: " + err.Error())
+	}
+
+	preserve, err := parseCharClasses(*preserveStr)
+	if err != nil {
+		return nil, errors.New("error parsing preserve_classes: " + err.Error())
+	}
+
+	key, keySource, fpeMode, fpeTweak, err := maskFlags.resolve()
+	if err != nil {
+		return nil, err
+	}
+	if *unique && fpeMode != "" {
+		return nil, errors.New("-unique applies to substitution; FPE never maps two values to one")
+	}
+
 	return &AppConfig{
-		InputPath:     *inputPath,
-		OutputFile:    "output.csv",
-		ColumnsToMask: columnsToMask,
-		ChunkSize:     10000,
-		Quiet:         *quiet,
-		Verbose:       *verbose,
-		JsonLogs:      *jsonLogs,
+		InputPath:       *inputPath,
+		OutputFile:      outputFile,
+		ColumnsToMask:   columnsToMask,
+		ChunkSize:       10000,
+		Quiet:           *quiet,
+		Verbose:         *verbose,
+		JsonLogs:        *jsonLogs,
+		MaskKey:         key,
+		MaskKeySource:   keySource,
+		FPEMode:         fpeMode,
+		FPEAlphabet:     *maskFlags.fpeAlphabet,
+		FPETweak:        fpeTweak,
+		FPEShortValues:  *maskFlags.fpeShort,
+		Preserve:        preserve,
+		PolicyPath:      *policyPath,
+		OutputFormat:    format,
+		ParquetCodec:    *parquetCodec,
+		InputFormat:     inFormat,
+		CSVDelimiter:    delimiter,
+		CSVHeader:       *csvHeader,
+		CSVLazyQuotes:   *csvLazyQuotes,
+		Resume:          *resume,
+		CheckpointEvery: *checkpointEvery,
+		Readers:         *readers,
+		Timezone:        loc,
+		KeepNulls:       *keepNulls,
+		Unique:          *unique,
+		CSVNull:         *csvNull,
+		CacheMemory:     cacheBytes,
+		CacheSpillDir:   *cacheSpillDir,
+		VaultPath:       *vaultPath,
+		VaultKey:        vaultKey,
+		VaultDomain:     *vaultDomain,
 	}, nil
 }
 
-func setupApplication(config *AppConfig) (*CSVWriter, error) {
-	err := initImprovedLogger(config.Quiet, config.Verbose, config.JsonLogs)
+// newMasker builds the masker selected by the configuration: FPE when a mode
+// is set, otherwise keyed substitution when a key is available, otherwise the
+// default random substitution
+func newMasker(config *AppConfig) (Masker, error) {
+	if config.FPEMode != "" {
+		fpeMasker, err := NewFPEMasker(config.FPEMode, config.MaskKey, config.FPETweak, config.FPEAlphabet)
+		if err != nil {
+			return nil, err
+		}
+		if config.FPEShortValues == fpeShortSubstitute {
+			fpeMasker.SubstituteShortValues()
+		}
+		logger.Info("Format-preserving encryption enabled", map[string]interface{}{
+			"fpe_mode":   string(config.FPEMode),
+			"alphabet":   config.FPEAlphabet,
+			"key_source": config.MaskKeySource,
+		})
+		return fpeMasker, nil
+	}
+
+	if config.MaskKey != nil {
+		masking = NewKeyedMaskingService(config.MaskKey)
+		logger.Info("Keyed masking enabled", map[string]interface{}{
+			"key_source": config.MaskKeySource,
+		})
+	}
+	masking.PreserveClasses(config.Preserve)
+	masking.domain = config.VaultDomain
+	if config.Unique {
+		masking.RequireUnique()
+	}
+
+	return masking, nil
+}
+
+// buildColumnMaskers decides which masker applies to which column, either from
+// the policy file or from -columns with the single command-line masker. It runs
+// against the input column names before any output is created.
+func buildColumnMaskers(config *AppConfig, columns []ColumnInfo) ([]ColumnMasker, error) {
+	if config.PolicyPath != "" {
+		policy, err := LoadPolicy(config.PolicyPath)
+		if err != nil {
+			return nil, err
+		}
+
+		maskers, err := policy.Build(columns, config.MaskKey)
+		if err == nil && strings.EqualFold(config.OutputFormat, "parquet") {
+			err = checkParquetTypes(maskers, columns)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy %s: %w", config.PolicyPath, err)
+		}
+
+		for _, col := range maskers {
+			logger.Debug("Column policy", map[string]interface{}{
+				"column_index": col.Index,
+				"column_path":  columns[col.Index].Path,
+				"masker":       fmt.Sprintf("%T", col.Masker),
+				"keep_nulls":   col.KeepNulls,
+			})
+		}
+		return maskers, nil
+	}
+
+	indexes, err := resolveColumns(config.ColumnsToMask, columns)
+	if err != nil {
+		return nil, err
+	}
+
+	masker, err := newMasker(config)
+	if err != nil {
+		return nil, err
+	}
+
+	maskers := make([]ColumnMasker, 0, len(indexes))
+	for _, index := range indexes {
+		maskers = append(maskers, ColumnMasker{Index: index, Masker: masker, KeepNulls: config.KeepNulls})
+	}
+	if strings.EqualFold(config.OutputFormat, "parquet") {
+		if err := checkParquetTypes(maskers, columns); err != nil {
+			return nil, err
+		}
+	}
+	return maskers, nil
+}
+
+// columnIndexes lists the masked column indexes for logging
+func columnIndexes(columns []ColumnMasker) []int {
+	indexes := make([]int, len(columns))
+	for i, col := range columns {
+		indexes[i] = col.Index
+	}
+	return indexes
+}
+
+// maskingJob is everything a run needs once setup has validated the input,
+// the maskers and the output
+type maskingJob struct {
+	source     RowSource
+	sink       RowSink
+	columns    []ColumnMasker
+	caches     *maskCaches
+	vault      *tokenVault   // nil without -vault
+	checkpoint *checkpointer // nil if the sink can't report its position
+
+	// resumedFrom is the temporary output of the run being resumed; it is
+	// removed once this run has finalized its own output
+	resumedFrom string
+}
+
+func setupApplication(config *AppConfig) (_ *maskingJob, err error) {
+	err = initImprovedLogger(config.Quiet, config.Verbose, config.JsonLogs)
 	if err != nil {
 		return nil, err
 	}
 
-	logger.Info("Starting parquet masking process", map[string]interface{}{
-		"input_file":      config.InputPath,
-		"chunk_size":      config.ChunkSize,
-		"output_file":     config.OutputFile,
-		"columns_to_mask": config.ColumnsToMask,
+	logger.Info("Starting masking process", map[string]interface{}{
+		"input_file":    config.InputPath,
+		"input_format":  config.InputFormat,
+		"chunk_size":    config.ChunkSize,
+		"output_file":   config.OutputFile,
+		"output_format": config.OutputFormat,
+		"policy_file":   config.PolicyPath,
+		"resume":        config.Resume,
+		"readers":       config.Readers,
 	})
 
-	os.Remove(config.OutputFile)
-	csvWriter, err := NewCSVWriter(config.OutputFile)
+	identity, err := readInputIdentity(config.InputPath)
 	if err != nil {
-		logger.LogError("CSV writer creation", err)
-		return nil, err
+		logger.LogError("Reading input", err)
+		return nil, newStageError(stageInput, err)
 	}
 
-	logger.Info("Initializing CSV output and reading schema")
-	if err := readWriteParquetSchema(config.InputPath); err != nil {
-		logger.LogError("Reading parquet schema", err)
-		csvWriter.Close()
-		return nil, err
+	var resumed *Checkpoint
+	if config.Resume {
+		resumed, err = loadCheckpoint(config.OutputFile, config.InputPath, config.OutputFormat)
+		if err != nil {
+			logger.LogError("Loading checkpoint", err)
+			return nil, newStageError(stageConfig, err)
+		}
+		logger.Info("Resuming from checkpoint", map[string]interface{}{
+			"rows_written":    resumed.RowsWritten,
+			"batches_written": resumed.BatchesWritten,
+			"output_bytes":    resumed.OutputBytes,
+		})
+	} else {
+		resumed = &Checkpoint{}
 	}
 
-	return csvWriter, nil
+	source, err := NewRowSource(config.InputFormat, config.InputPath, SourceOptions{
+		CSVDelimiter:  config.CSVDelimiter,
+		CSVHeader:     config.CSVHeader,
+		CSVLazyQuotes: config.CSVLazyQuotes,
+		CSVNull:       config.CSVNull,
+		SkipRows:      resumed.RowsWritten,
+		Readers:       config.Readers,
+		Timezone:      config.Timezone,
+	})
+	if err != nil {
+		logger.LogError("Reading input schema", err)
+		return nil, newStageError(stageInput, err)
+	}
+	schema := source.Schema()
+
+	columns, err := buildColumnMaskers(config, schema.Columns)
+	if err != nil {
+		logger.LogError("Masker creation", err)
+		return nil, newStageError(stageConfig, err)
+	}
+	// The vault and the spill store are only handed on with the job
+	var vault *tokenVault
+	var caches *maskCaches
+	defer func() {
+		if err != nil {
+			caches.Close()
+			vault.Close()
+		}
+	}()
+	if config.VaultPath != "" {
+		if vault, err = openVault(config.VaultPath, config.VaultKey); err != nil {
+			logger.LogError("Opening vault", err)
+			return nil, newStageError(stageConfig, err)
+		}
+		logger.Info("Token vault enabled", map[string]interface{}{
+			"vault":   config.VaultPath,
+			"domains": useVault(columns, vault),
+		})
+	}
+	caches, err = limitCaches(columns, config.CacheMemory, config.CacheSpillDir)
+	if err != nil {
+		logger.LogError("Masker creation", err)
+		return nil, newStageError(stageConfig, err)
+	}
+
+	logger.Info("Masking configuration validated", map[string]interface{}{
+		"columns_to_mask": columnIndexes(columns),
+	})
+
+	sink, err := NewRowSink(config.OutputFormat, config.OutputFile, SinkOptions{
+		ParquetCodec: config.ParquetCodec,
+		CSVNull:      config.CSVNull,
+	})
+	if err != nil {
+		logger.LogError("Output sink creation", err)
+		return nil, newStageError(stageConfig, err)
+	}
+
+	job := &maskingJob{source: source, sink: sink, columns: columns, caches: caches, vault: vault}
+	rs, ok := sink.(ResumableSink)
+	if ok && rs.CanResume() {
+		if job.checkpoint, err = newCheckpointer(config, identity, rs, schema, columns, vault, resumed); err != nil {
+			logger.LogError("Preparing checkpoints", err)
+			return nil, newStageError(stageConfig, err)
+		}
+	}
+
+	if config.Resume {
+		if job.checkpoint == nil {
+			return nil, newStageError(stageConfig, fmt.Errorf("%s output cannot be resumed", config.OutputFormat))
+		}
+
+		from, err := resumed.resumeFrom()
+		if err == nil {
+			err = rs.Resume(schema, from, resumed.OutputBytes)
+		}
+		if err != nil {
+			logger.LogError("Resuming output", err)
+			return nil, newStageError(stageOutput, err)
+		}
+		job.resumedFrom = resumed.PartialPath
+		return job, nil
+	}
+
+	logger.Info("Opening output with input schema")
+	if err := sink.Open(schema); err != nil {
+		logger.LogError("Opening output sink", err)
+		return nil, newStageError(stageOutput, err)
+	}
+
+	return job, nil
 }
 
-func startParquetReader(inputPath string, chunkChan chan<- [][]string, chunkSize int) {
+// runPipeline streams the source through the maskers into the sink. The
+// reader, masker and writer stages run concurrently; the first failure
+// cancels the others and is returned tagged with its stage. Cancelling stop
+// only halts the reader: batches already read are still masked and written,
+// and runPipeline returns errInterrupted.
+//
+// With several readers batches may reach the writer out of order; a reorder
+// buffer restores input order, and a window of a task per reader beyond the
+// channel buffers bounds how far readers may run ahead of the writer.
+func runPipeline(ctx, stop context.Context, job *maskingJob, chunkSize, readers int) (int, int, error) {
+	g, ctx := newStageGroup(ctx)
+
+	readCtx, cancelRead := context.WithCancel(ctx)
+	defer cancelRead()
 	go func() {
-		if err := ReadParquetInChunks(inputPath, chunkChan, chunkSize); err != nil {
-			logger.LogError("Reading parquet chunks", err, map[string]interface{}{
-				"input_path": inputPath,
-				"chunk_size": chunkSize,
-			})
-			panic(err)
+		select {
+		case <-stop.Done():
+			cancelRead()
+		case <-readCtx.Done():
 		}
-		logger.Debug("Finished reading all parquet chunks")
 	}()
+
+	const channelBuffer = 10
+	chunkChan := make(chan Batch, channelBuffer)
+	processedChunkChan := make(chan Batch, channelBuffer)
+
+	window := newSeqWindow(readers*readerTaskBatches + 2*channelBuffer)
+	reorder := newReorderBuffer(window)
+
+	var rowCount, batchCount int
+	var interrupted bool
+	g.Go(func() error {
+		err := runReader(readCtx, job.source, chunkChan, chunkSize, window)
+		if err != nil && ctx.Err() == nil && stop.Err() != nil {
+			// Stopped by a signal, not a failure: let the other stages drain
+			interrupted = true
+			return nil
+		}
+		return err
+	})
+	g.Go(func() error {
+		return runBatchProcessor(ctx, chunkChan, processedChunkChan, job.columns)
+	})
+	g.Go(func() error {
+		var err error
+		rowCount, batchCount, err = writeProcessedData(ctx, job.sink, processedChunkChan, reorder, job.checkpoint)
+		return err
+	})
+
+	err := g.Wait()
+	if err == nil && interrupted {
+		// Batches read after a gap were never written and are dropped; the
+		// checkpoint covers the rows before the gap
+		err = errInterrupted
+	}
+	if seq, missing := reorder.Missing(); err == nil && missing {
+		err = newStageError(stageInput, fmt.Errorf("batch %d never arrived from the reader", seq))
+	}
+	return rowCount, batchCount, err
 }
 
-func startBatchProcessor(chunkChan <-chan [][]string, processedChunkChan chan<- [][]string, columnsToMask []int) {
-	go func() {
-		batchCount := 0
-		for batch := range chunkChan {
-			batchCount++
-
-			logger.Debug("Processing batch", map[string]interface{}{
-				"batch_number":    batchCount,
-				"batch_size":      len(batch),
-				"columns_to_mask": columnsToMask,
-				"masking_strategy": func() string {
-					if len(batch) > 500 {
-						return "parallel_workers"
-					}
-					return "simple_parallel"
-				}(),
-			})
+func runReader(ctx context.Context, source RowSource, chunkChan chan<- Batch, chunkSize int, window *seqWindow) error {
+	if err := source.ReadChunks(ctx, chunkChan, chunkSize, window); err != nil {
+		if ctx.Err() != nil {
+			return err // another stage failed first
+		}
+		logger.LogError("Reading input chunks", err, map[string]interface{}{
+			"chunk_size": chunkSize,
+		})
+		return newStageError(stageInput, err)
+	}
+	logger.Debug("Finished reading all input chunks")
+	return nil
+}
 
-			var maskedBatch [][]string
-			if len(batch) > 500 {
-				maskedBatch = MaskBatchParallelWorkers(batch, columnsToMask)
-			} else {
-				maskedBatch = MaskBatchParallel(batch, columnsToMask)
-			}
+func runBatchProcessor(ctx context.Context, chunkChan <-chan Batch, processedChunkChan chan<- Batch, columns []ColumnMasker) error {
+	defer close(processedChunkChan)
 
-			processedChunkChan <- maskedBatch
+	batchCount := 0
+	for batch := range chunkChan {
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
-		close(processedChunkChan)
-		logger.Debug("Finished processing all batches", map[string]interface{}{
-			"total_batches": batchCount,
+		batchCount++
+
+		logger.Debug("Processing batch", map[string]interface{}{
+			"batch_number":    batchCount,
+			"batch_seq":       batch.Seq,
+			"batch_size":      batch.Len(),
+			"columns_to_mask": columnIndexes(columns),
+			"masking_strategy": func() string {
+				if batch.Len() > 500 {
+					return "parallel_workers"
+				}
+				return "simple_parallel"
+			}(),
 		})
-	}()
+
+		var maskedBatch Batch
+		var err error
+		if batch.Len() > 500 {
+			maskedBatch, err = MaskBatchParallelWorkers(batch, columns)
+		} else {
+			maskedBatch, err = MaskBatchParallel(batch, columns)
+		}
+		if err != nil {
+			logger.LogError("Masking batch", err, map[string]interface{}{
+				"batch_number": batchCount,
+				"batch_seq":    batch.Seq,
+			})
+			return newStageError(stageMask, fmt.Errorf("batch %d: %w", batch.Seq, err))
+		}
+
+		if err := sendChunk(ctx, processedChunkChan, maskedBatch); err != nil {
+			return err
+		}
+	}
+
+	logger.Debug("Finished processing all batches", map[string]interface{}{
+		"total_batches": batchCount,
+	})
+	return nil
 }
 
-func writeProcessedData(csvWriter *CSVWriter, processedChunkChan <-chan [][]string) (int, int, error) {
-	logger.Info("Starting CSV writing process")
+// writeProcessedData writes batches to the sink in sequence order, flushing
+// periodically and saving a checkpoint every cp.every batches when enabled
+func writeProcessedData(ctx context.Context, sink RowSink, processedChunkChan <-chan Batch, reorder *reorderBuffer, cp *checkpointer) (int, int, error) {
+	logger.Info("Starting output writing process")
 	var rowCount int
 	var batchCount int
 	const flushInterval = 5
 
-	for batch := range processedChunkChan {
-		if err := csvWriter.WriteRowsNoFlush(batch); err != nil {
-			logger.LogError("Writing batch to CSV", err, map[string]interface{}{
+	var ready []Batch
+	for {
+		if len(ready) == 0 {
+			var chunk Batch
+			var ok bool
+			select {
+			case chunk, ok = <-processedChunkChan:
+			case <-ctx.Done():
+				return rowCount, batchCount, ctx.Err()
+			}
+			if !ok {
+				break
+			}
+			ready = reorder.Add(chunk)
+			continue
+		}
+
+		batch := ready[0]
+		ready = ready[1:]
+
+		if err := sink.WriteBatch(batch); err != nil {
+			logger.LogError("Writing batch to output", err, map[string]interface{}{
 				"batch_number": batchCount,
-				"batch_size":   len(batch),
+				"batch_size":   batch.Len(),
 			})
-			return rowCount, batchCount, err
+			return rowCount, batchCount, newStageError(stageOutput, err)
 		}
 
 		batchCount++
-		rowCount += len(batch)
+		rowCount += batch.Len()
 
-		if batchCount%flushInterval == 0 {
-			if err := csvWriter.Flush(); err != nil {
-				logger.LogError("Flushing CSV writer", err, map[string]interface{}{
+		saveCheckpoint := cp != nil && cp.every > 0 && batchCount%cp.every == 0
+		if batchCount%flushInterval == 0 || saveCheckpoint {
+			if err := sink.Flush(); err != nil {
+				logger.LogError("Flushing output writer", err, map[string]interface{}{
 					"batch_number": batchCount,
 				})
-				return rowCount, batchCount, err
+				return rowCount, batchCount, newStageError(stageOutput, err)
 			}
 		}
 
+		// Masking state is written as it grows, not only with checkpoints
+		if cp != nil && batchCount%flushInterval == 0 && !saveCheckpoint {
+			if err := cp.saveState(); err != nil {
+				logger.LogError("Writing masking state", err)
+				return rowCount, batchCount, newStageError(stageOutput, err)
+			}
+		}
+
+		if saveCheckpoint {
+			if err := cp.Save("running", rowCount, batchCount); err != nil {
+				logger.LogError("Writing checkpoint", err, map[string]interface{}{
+					"batch_number": batchCount,
+				})
+				return rowCount, batchCount, newStageError(stageOutput, err)
+			}
+			logger.Debug("Checkpoint written", map[string]interface{}{
+				"rows_written": cp.baseRows + int64(rowCount),
+			})
+		}
+
 		if rowCount%10000 == 0 {
 			logger.LogProgress(rowCount, batchCount, "Processing progress update")
 		}
 	}
 
+	// A failed upstream stage may already have cancelled the run
+	if ctx.Err() != nil {
+		return rowCount, batchCount, ctx.Err()
+	}
+
 	logger.Debug("Performing final flush")
-	if err := csvWriter.Flush(); err != nil {
+	if err := sink.Flush(); err != nil {
 		logger.LogError("Final flush", err)
-		return rowCount, batchCount, err
+		return rowCount, batchCount, newStageError(stageOutput, err)
 	}
 
 	return rowCount, batchCount, nil
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		var command func([]string) error
+		switch os.Args[1] {
+		case "unmask":
+			command = runUnmask
+		case "vault-export":
+			command = runVaultExport
+		case "vault-import":
+			command = runVaultImport
+		}
+		if command != nil {
+			if err := command(os.Args[2:]); err != nil {
+				log.Printf("Error running %s: %v", os.Args[1], err)
+				os.Exit(exitCode(err))
+			}
+			return
+		}
+	}
+
+	os.Exit(run())
+}
+
+// handleShutdownSignals calls stop on the first SIGINT or SIGTERM. The
+// default handlers are restored afterwards, so a second signal kills the
+// process immediately.
+func handleShutdownSignals(stop context.CancelFunc) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-sigChan
+		signal.Reset(os.Interrupt, syscall.SIGTERM)
+		logger.Warn("Shutdown requested; finishing in-flight batches", map[string]interface{}{
+			"signal": sig.String(),
+		})
+		stop()
+	}()
+}
+
+// finishInterrupted keeps what was written before the signal for -resume: the
+// temporary output stays next to the output path, which is left untouched,
+// and a checkpoint records it with the last completed row. Output that can't
+// be resumed (parquet) is discarded as for a failed run.
+func finishInterrupted(config *AppConfig, job *maskingJob, rowCount, batchCount int) int {
+	fields := map[string]interface{}{
+		"rows_written":    rowCount,
+		"batches_written": batchCount,
+	}
+
+	if job.checkpoint == nil {
+		job.sink.Abort()
+		logger.Warn("Processing interrupted; output discarded as "+config.OutputFormat+" output can't be resumed", fields)
+		return exitInterrupted
+	}
+
+	if err := job.checkpoint.Save("interrupted", rowCount, batchCount); err != nil {
+		logger.LogError("Writing checkpoint", err, map[string]interface{}{
+			"checkpoint_file": job.checkpoint.path,
+		})
+		job.sink.Abort()
+		return exitOutput
+	}
+	partialPath, _, _ := job.checkpoint.sink.Position()
+	if err := job.checkpoint.sink.Detach(); err != nil {
+		logger.LogError("Closing partial output", err)
+		log.Printf("Masking interrupted and partial output could not be closed: %v", err)
+		return exitOutput
+	}
+	if job.resumedFrom != "" {
+		os.Remove(job.resumedFrom)
+	}
+
+	fields["checkpoint_file"] = job.checkpoint.path
+	fields["partial_file"] = partialPath
+	logger.Warn("Processing interrupted", fields)
+	return exitInterrupted
+}
+
+// abortJob discards the output of a failed run, unless periodic checkpoints
+// point at it: then the temporary output is kept so -resume can continue
+func abortJob(job *maskingJob) {
+	if job.checkpoint != nil && job.checkpoint.saved > 0 {
+		if err := job.checkpoint.sink.Detach(); err == nil {
+			logger.Warn("Partial output kept for -resume", map[string]interface{}{
+				"checkpoint_file": job.checkpoint.path,
+			})
+			return
+		}
+	}
+	job.sink.Abort()
+	if job.checkpoint != nil && job.checkpoint.ownsState && job.checkpoint.saved == 0 {
+		job.checkpoint.removeState()
+	}
+}
+
+// run performs a masking run and returns the process exit code; it is
+// separate from main so deferred cleanup runs before os.Exit
+func run() int {
 	config, err := parseCommandLineArgs()
 	if err != nil {
-		log.Fatalf("Error parsing command line arguments: %v", err)
+		log.Printf("Error parsing command line arguments: %v", err)
+		return exitUsage
 	}
 
+	status := "failed"
+	var job *maskingJob
 	defer timer("main", config.Quiet)()
 	defer func() {
 		if logger != nil {
-			logger.LogFinalSummary()
+			var cacheStats, vaultStats map[string]interface{}
+			if job != nil {
+				cacheStats = job.caches.summary()
+				job.caches.Close()
+				if err := job.vault.Close(); err != nil {
+					logger.LogError("Closing vault", err)
+				}
+				vaultStats = job.vault.summary()
+			}
+			logger.LogFinalSummary(status, cacheStats, vaultStats)
 			logger.Close()
 		}
 	}()
 
-	csvWriter, err := setupApplication(config)
+	job, err = setupApplication(config)
 	if err != nil {
-		log.Fatal(err)
+		log.Print(err)
+		return exitCode(err)
 	}
-	defer csvWriter.Close()
 
-	chunkChan := make(chan [][]string, 10)
-	processedChunkChan := make(chan [][]string, 10)
+	stop, cancelStop := context.WithCancel(context.Background())
+	defer cancelStop()
+	handleShutdownSignals(cancelStop)
+
+	rowCount, batchCount, err := runPipeline(context.Background(), stop, job, config.ChunkSize, config.Readers)
+	logger.LogProgress(rowCount, batchCount, "Rows written")
 
-	startParquetReader(config.InputPath, chunkChan, config.ChunkSize)
-	startBatchProcessor(chunkChan, processedChunkChan, config.ColumnsToMask)
+	if errors.Is(err, errInterrupted) {
+		status = "interrupted"
+		return finishInterrupted(config, job, rowCount, batchCount)
+	}
 
-	rowCount, batchCount, err := writeProcessedData(csvWriter, processedChunkChan)
 	if err != nil {
-		panic(err)
+		abortJob(job)
+		log.Printf("Masking failed: %v", err)
+		return exitCode(err)
+	}
+
+	// The output is only consistent with later runs once its new tokens are
+	// in the vault, so it is discarded if they can't be written
+	if err := job.vault.Close(); err != nil {
+		abortJob(job)
+		logger.LogError("Closing vault", err)
+		log.Printf("Masking failed: %v", err)
+		return exitOutput
+	}
+
+	// Closing finalizes the output (parquet writes its footer here) and moves
+	// it into place; on failure the temporary file has already been removed
+	if err := job.sink.Close(); err != nil {
+		logger.LogError("Closing output", err)
+		log.Printf("Masking failed: %v", err)
+		return exitOutput
+	}
+
+	// A finished run supersedes the checkpoint and partial output of an
+	// earlier one
+	os.Remove(checkpointPath(config.OutputFile))
+	job.checkpoint.removeState()
+	if job.resumedFrom != "" {
+		os.Remove(job.resumedFrom)
 	}
 
+	status = "completed"
 	logger.Info("Processing completed successfully", map[string]interface{}{
 		"total_rows_processed":    rowCount,
 		"total_batches_processed": batchCount,
 	})
+	return exitOK
 }
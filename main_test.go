@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// writeParquetFixture writes rows of the struct type that schema points to,
+// starting a new row group every rowGroupSize bytes (0 keeps the default)
+func writeParquetFixture(t testing.TB, path string, schema interface{}, rows []interface{}, rowGroupSize int64) {
+	t.Helper()
+	fw, err := local.NewLocalFileWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw, err := writer.NewParquetWriter(fw, schema, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rowGroupSize > 0 {
+		pw.RowGroupSize = rowGroupSize
+	}
+	for _, row := range rows {
+		if err := pw.Write(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pw.WriteStop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// parseArgs parses command-line flags as the masking command does, so
+// defaults apply as they would in a run
+func parseArgs(t *testing.T, args ...string) *AppConfig {
+	t.Helper()
+	config, err := tryParseArgs(args...)
+	if err != nil {
+		t.Fatalf("parsing %q: %v", args, err)
+	}
+	return config
+}
+
+// tryParseArgs is parseArgs for flags that may be refused
+func tryParseArgs(args ...string) (*AppConfig, error) {
+	commandLine, osArgs := flag.CommandLine, os.Args
+	defer func() { flag.CommandLine, os.Args = commandLine, osArgs }()
+
+	flag.CommandLine = flag.NewFlagSet("masking", flag.ContinueOnError)
+	os.Args = append([]string{"masking"}, args...)
+	return parseCommandLineArgs()
+}
+
+// runJob performs a complete masking run as run does, from inside a
+// temporary working directory so app.log stays out of the tree, and returns
+// the output
+func runJob(t *testing.T, config *AppConfig) []byte {
+	t.Helper()
+	t.Chdir(t.TempDir())
+
+	config.Quiet = true
+	if config.ChunkSize == 0 {
+		config.ChunkSize = 10000
+	}
+	if config.Readers == 0 {
+		config.Readers = 1
+	}
+	if config.VaultDomain == "" {
+		config.VaultDomain = "default"
+	}
+
+	job, err := setupApplication(config)
+	if err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+	defer logger.Close()
+	defer job.caches.Close()
+
+	ctx := context.Background()
+	if _, _, err := runPipeline(ctx, ctx, job, config.ChunkSize, config.Readers); err != nil {
+		abortJob(job)
+		t.Fatalf("masking: %v", err)
+	}
+	if err := job.vault.Close(); err != nil {
+		t.Fatalf("closing vault: %v", err)
+	}
+	if err := job.sink.Close(); err != nil {
+		t.Fatalf("closing output: %v", err)
+	}
+
+	out, err := os.ReadFile(config.OutputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// testPath names a file in a directory removed after the test
+func testPath(t testing.TB, name string) string {
+	t.Helper()
+	return filepath.Join(t.TempDir(), name)
+}
+
+// TestPolicyFlagConflicts checks that flags a policy file replaces are
+// refused next to -policy rather than silently ignored
+func TestPolicyFlagConflicts(t *testing.T) {
+	for _, args := range [][]string{
+		{"-columns", "name"},
+		{"-fpe", "ff1"},
+		{"-fpe_alphabet", "digits"},
+		{"-fpe_tweak", "00"},
+		{"-fpe_short_values", "substitute"},
+		{"-preserve_classes", "digit"},
+		{"-keep_nulls=false"},
+		{"-unique"},
+		{"-vault_domain", "customers"},
+	} {
+		name, _, _ := strings.Cut(args[0], "=")
+		_, err := tryParseArgs(append([]string{"-policy", "masking.yaml", "-mask_key", "secret"}, args...)...)
+		if err == nil || !strings.Contains(err.Error(), "-policy cannot be combined with "+name) {
+			t.Errorf("-policy with %s = %v, want a conflict", name, err)
+		}
+	}
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"hash/maphash"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// cacheEntryOverhead approximates the memory an entry costs beyond its two
+// strings: map slot, list element and string headers
+const cacheEntryOverhead = 128
+
+// spillBatchSize is how many evicted entries are collected before they are
+// written to the spill store in one transaction
+const spillBatchSize = 10000
+
+// cacheShards is the number of independently locked parts of a cache; a power
+// of two so an input's shard is a mask of its hash
+const cacheShards = 64
+
+// maskCache holds the substitutions of a MaskingService, partitioned by hash
+// into shards so parallel workers rarely wait on each other. Unbounded shards
+// are a plain map; bounded ones keep the most recently used entries within
+// their share of the limit and move the rest to a spill store if one is set,
+// so they are still found, or otherwise forget them (keyed services recompute
+// them).
+type maskCache struct {
+	seed   maphash.Seed
+	shards [cacheShards]cacheShard
+	store  *spillStore
+	bucket string
+
+	pendingMu sync.Mutex
+	pending   map[string]string // evicted but not yet written to store
+}
+
+type cacheShard struct {
+	mu       sync.RWMutex
+	values   map[string]string        // unbounded caches
+	entries  map[string]*list.Element // bounded caches; values are *cacheEntry
+	lru      *list.List               // most recently used first
+	maxBytes int64
+	bytes    int64
+
+	hits, misses, evictions atomic.Int64
+}
+
+type cacheEntry struct {
+	input, masked string
+}
+
+func newMaskCache() *maskCache {
+	c := &maskCache{seed: maphash.MakeSeed()}
+	for i := range c.shards {
+		c.shards[i].values = make(map[string]string)
+	}
+	return c
+}
+
+// limit bounds the cache to maxBytes, spilling evicted entries to bucket of
+// store when store is non-nil. It must be called before the cache is used.
+func (c *maskCache) limit(maxBytes int64, store *spillStore, bucket string) {
+	c.store, c.bucket = store, bucket
+	if store != nil {
+		c.pending = make(map[string]string)
+	}
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.maxBytes = maxBytes / cacheShards
+		sh.values = nil
+		sh.entries = make(map[string]*list.Element)
+		sh.lru = list.New()
+	}
+}
+
+func entrySize(input, masked string) int64 {
+	return int64(len(input) + len(masked) + cacheEntryOverhead)
+}
+
+func (c *maskCache) shard(input string) *cacheShard {
+	return &c.shards[maphash.String(c.seed, input)&(cacheShards-1)]
+}
+
+// loadOrStore returns the substitution of input, recording mask() as its
+// substitution if there is none yet. mask runs under the shard lock, so
+// goroutines racing on the same input all get the one substitution stored.
+func (c *maskCache) loadOrStore(input string, mask func() (string, error)) (string, error) {
+	sh := c.shard(input)
+	if sh.lru == nil {
+		sh.mu.RLock()
+		masked, ok := sh.values[input]
+		sh.mu.RUnlock()
+		if ok {
+			sh.hits.Add(1)
+			return masked, nil
+		}
+
+		sh.mu.Lock()
+		defer sh.mu.Unlock()
+		if masked, ok := sh.values[input]; ok {
+			sh.hits.Add(1) // stored by another goroutine since the read
+			return masked, nil
+		}
+		sh.misses.Add(1)
+		masked, err := mask()
+		if err != nil {
+			return "", err
+		}
+		sh.values[input] = masked
+		return masked, nil
+	}
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if elem, ok := sh.entries[input]; ok {
+		sh.lru.MoveToFront(elem)
+		sh.hits.Add(1)
+		return elem.Value.(*cacheEntry).masked, nil
+	}
+
+	if c.store != nil {
+		masked, ok, err := c.spilled(input)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			sh.hits.Add(1)
+			return masked, c.insert(sh, input, masked)
+		}
+	}
+
+	sh.misses.Add(1)
+	masked, err := mask()
+	if err != nil {
+		return "", err
+	}
+	return masked, c.insert(sh, input, masked)
+}
+
+// insert adds an entry to a bounded shard, evicting its least recently used
+// entries to make room; sh.mu must be held
+func (c *maskCache) insert(sh *cacheShard, input, masked string) error {
+	sh.entries[input] = sh.lru.PushFront(&cacheEntry{input: input, masked: masked})
+	sh.bytes += entrySize(input, masked)
+
+	for sh.bytes > sh.maxBytes && sh.lru.Len() > 1 {
+		oldest := sh.lru.Remove(sh.lru.Back()).(*cacheEntry)
+		delete(sh.entries, oldest.input)
+		sh.bytes -= entrySize(oldest.input, oldest.masked)
+		sh.evictions.Add(1)
+
+		if c.store != nil {
+			if err := c.spill(oldest.input, oldest.masked); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// spill queues an evicted entry for the spill store, writing the queue once
+// it is full. An input only moves under its shard lock, which the caller
+// holds, so it can't be looked up while it is on its way.
+func (c *maskCache) spill(input, masked string) error {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+
+	c.pending[input] = masked
+	if len(c.pending) < spillBatchSize {
+		return nil
+	}
+	if err := c.store.write(c.bucket, c.pending); err != nil {
+		return err
+	}
+	c.pending = make(map[string]string)
+	return nil
+}
+
+// spilled looks an evicted entry up in the queue, then in the spill store
+func (c *maskCache) spilled(input string) (string, bool, error) {
+	c.pendingMu.Lock()
+	masked, ok := c.pending[input]
+	c.pendingMu.Unlock()
+	if ok {
+		return masked, true, nil
+	}
+	return c.store.read(c.bucket, input)
+}
+
+// stats sums the lookups and evictions of all shards
+func (c *maskCache) stats() (hits, misses, evictions int64) {
+	for i := range c.shards {
+		sh := &c.shards[i]
+		hits += sh.hits.Load()
+		misses += sh.misses.Load()
+		evictions += sh.evictions.Load()
+	}
+	return hits, misses, evictions
+}
+
+// spillStore keeps entries evicted from bounded caches in a bbolt file, one
+// bucket per cache. Entries are stored under an HMAC of the input and sealed
+// with a key that only exists in memory for the run, so a file left behind
+// (by a crash or a second signal) reveals nothing. The file is created in dir
+// on the first write and removed by Close.
+type spillStore struct {
+	dir    string
+	macs   sync.Pool // HMAC-SHA256 hashes for index
+	sealer *sealer
+	mu     sync.Mutex
+	db     *bolt.DB
+	path   string
+}
+
+// spillIndexSize is how many bytes of the HMAC of an input are kept as its key
+const spillIndexSize = 16
+
+func newSpillStore(dir string) (*spillStore, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to create cache spill key: %w", err)
+	}
+	s, err := newSealer(deriveKey(secret, "go_masking spill seal"))
+	if err != nil {
+		return nil, err
+	}
+	store := &spillStore{dir: dir, sealer: s}
+	indexKey := deriveKey(secret, "go_masking spill index")
+	store.macs.New = func() interface{} { return hmac.New(sha256.New, indexKey) }
+	return store, nil
+}
+
+// index is the key an input is stored under
+func (s *spillStore) index(input string) []byte {
+	mac := s.macs.Get().(hash.Hash)
+	defer s.macs.Put(mac)
+	mac.Reset()
+	mac.Write([]byte(input))
+	return mac.Sum(make([]byte, 0, sha256.Size))[:spillIndexSize]
+}
+
+// open returns the database, creating it if create is set; nil before the
+// first write
+func (s *spillStore) open(create bool) (*bolt.DB, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.db != nil || !create {
+		return s.db, nil
+	}
+
+	tmp, err := os.CreateTemp(s.dir, "masking-cache-*.db")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cache spill file: %w", err)
+	}
+	tmp.Close()
+
+	// The file only lives as long as the run, so it is never synced
+	db, err := bolt.Open(tmp.Name(), 0600, &bolt.Options{NoSync: true, NoFreelistSync: true})
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("failed to open cache spill file: %w", err)
+	}
+
+	s.db, s.path = db, tmp.Name()
+	return db, nil
+}
+
+func (s *spillStore) write(bucket string, entries map[string]string) error {
+	db, err := s.open(true)
+	if err != nil {
+		return err
+	}
+
+	type record struct{ key, value []byte }
+	records := make([]record, 0, len(entries))
+	for input, masked := range entries {
+		key := s.index(input)
+		value, err := s.sealer.seal([]byte(masked), key)
+		if err != nil {
+			return fmt.Errorf("sealing spilled cache entry: %w", err)
+		}
+		records = append(records, record{key, value})
+	}
+	// bbolt inserts sorted keys far faster than random ones
+	sort.Slice(records, func(i, j int) bool { return bytes.Compare(records[i].key, records[j].key) < 0 })
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		for _, r := range records {
+			if err := b.Put(r.key, r.value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to spill masking cache: %w", err)
+	}
+	return nil
+}
+
+func (s *spillStore) read(bucket, input string) (string, bool, error) {
+	db, err := s.open(false)
+	if db == nil || err != nil {
+		return "", false, err
+	}
+
+	key := s.index(input)
+	var masked []byte
+	var found bool
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		sealed := b.Get(key)
+		if sealed == nil {
+			return nil
+		}
+		// open copies, as sealed is only valid inside the transaction
+		masked, err = s.sealer.open(sealed, key)
+		found = err == nil
+		return err
+	})
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read spilled masking cache: %w", err)
+	}
+	return string(masked), found, nil
+}
+
+// Close closes and removes the spill file
+func (s *spillStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.db == nil {
+		return nil
+	}
+	err := s.db.Close()
+	os.Remove(s.path)
+	s.db = nil
+	return err
+}
+
+// maskCaches are the caches of the substitution maskers of a run
+type maskCaches struct {
+	caches []*maskCache
+	store  *spillStore // nil without a spill directory
+}
+
+// limitCaches splits maxBytes evenly between the substitution maskers in
+// columns, and a unique masker's share in half between its cache and its
+// reverse index; 0 leaves them unbounded. Random substitution has to remember
+// every value to stay consistent, and unique substitution every result it
+// handed out, so bounding them needs spillDir unless a vault keeps them.
+func limitCaches(columns []ColumnMasker, maxBytes int64, spillDir string) (*maskCaches, error) {
+	mc := &maskCaches{}
+	seen := make(map[*MaskingService]bool)
+	var services []*MaskingService
+	for _, col := range columns {
+		if ms, ok := col.Masker.(*MaskingService); ok && !seen[ms] {
+			seen[ms] = true
+			services = append(services, ms)
+			mc.caches = append(mc.caches, ms.cache)
+		}
+	}
+
+	if maxBytes == 0 || len(services) == 0 {
+		return mc, nil
+	}
+
+	if spillDir != "" {
+		var err error
+		if mc.store, err = newSpillStore(spillDir); err != nil {
+			return nil, err
+		}
+	}
+
+	share := maxBytes / int64(len(services))
+	for i, ms := range services {
+		if ms.key == nil && ms.vault == nil && mc.store == nil {
+			return nil, fmt.Errorf("random substitution must remember every value to stay consistent; set -cache_spill_dir, -vault or a masking key to bound its memory")
+		}
+
+		cacheShare := share
+		if ms.unique != nil {
+			if ms.vault == nil && mc.store == nil {
+				return nil, fmt.Errorf("unique substitution must remember every result it hands out; set -cache_spill_dir or -vault to bound its memory")
+			}
+			var store *spillStore
+			if ms.vault == nil {
+				store = mc.store // a vault keeps the owners of its tokens
+			}
+			cacheShare = share / 2
+			ms.unique.limit(share-cacheShare, store, "unique-"+strconv.Itoa(i))
+		}
+
+		var store *spillStore
+		if ms.key == nil && ms.vault == nil {
+			store = mc.store // keyed substitutions are recomputed, vault ones looked up
+		}
+		ms.cache.limit(cacheShare, store, "cache-"+strconv.Itoa(i))
+	}
+	return mc, nil
+}
+
+// summary reports hits, misses and evictions for the final log entry; nil
+// when no substitution masker was used
+func (mc *maskCaches) summary() map[string]interface{} {
+	if mc == nil || len(mc.caches) == 0 {
+		return nil
+	}
+
+	var hits, misses, evictions int64
+	for _, c := range mc.caches {
+		h, m, e := c.stats()
+		hits, misses, evictions = hits+h, misses+m, evictions+e
+	}
+
+	ratio := 0.0
+	if hits+misses > 0 {
+		ratio = float64(hits) / float64(hits+misses)
+	}
+	return map[string]interface{}{
+		"cache_hits":      hits,
+		"cache_misses":    misses,
+		"cache_hit_ratio": fmt.Sprintf("%.1f%%", ratio*100),
+		"cache_evictions": evictions,
+	}
+}
+
+// Close removes the spill file, if one was created
+func (mc *maskCaches) Close() error {
+	if mc == nil || mc.store == nil {
+		return nil
+	}
+	return mc.store.Close()
+}
+
+// parseByteSize reads a size such as 512MB, 2GB or 1048576; the units KB, MB
+// and GB are powers of 1024
+func parseByteSize(size string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s, multiplier = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix)), unit.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size '%s' (expected e.g. 512MB, 2GB or a number of bytes)", size)
+	}
+	if n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("size '%s' is too large", size)
+	}
+	return n * multiplier, nil
+}
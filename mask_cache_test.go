@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{"0", 0},
+		{"1048576", 1 << 20},
+		{"512MB", 512 << 20},
+		{" 2 gb ", 2 << 30},
+		{"8589934591GB", 8589934591 << 30},
+	}
+	for _, tt := range tests {
+		if got, err := parseByteSize(tt.in); err != nil || got != tt.want {
+			t.Errorf("parseByteSize(%q) = %d, %v; want %d", tt.in, got, err, tt.want)
+		}
+	}
+
+	for _, in := range []string{"", "-1", "1.5GB", "12XB", "8589934592GB", "9223372036854775807KB"} {
+		if got, err := parseByteSize(in); err == nil {
+			t.Errorf("parseByteSize(%q) = %d, want an error", in, got)
+		}
+	}
+}
+
+// TestSpillStoreSealed checks that evicted substitutions are still found and
+// that the spill file holds neither inputs nor substitutions in the clear
+func TestSpillStoreSealed(t *testing.T) {
+	store, err := newSpillStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	c := newMaskCache()
+	c.limit(64*1024, store, "cache-0")
+
+	const n = 30000
+	for i := 0; i < n; i++ {
+		input := fmt.Sprintf("input-%05d", i)
+		if _, err := c.loadOrStore(input, func() (string, error) { return "masked-" + input, nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, evictions := c.stats(); evictions < n/2 {
+		t.Fatalf("only %d evictions; the cache limit is too loose for the test", evictions)
+	}
+
+	for i := 0; i < n; i += 997 {
+		input := fmt.Sprintf("input-%05d", i)
+		masked, err := c.loadOrStore(input, func() (string, error) { return "", fmt.Errorf("%s was forgotten", input) })
+		if err != nil || masked != "masked-"+input {
+			t.Errorf("loadOrStore(%s) = %q, %v", input, masked, err)
+		}
+	}
+
+	data, err := os.ReadFile(store.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("input-0")) || bytes.Contains(data, []byte("masked-")) {
+		t.Error("spill file holds entries in the clear")
+	}
+
+	path := store.path
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("spill file %s left behind after Close", path)
+	}
+}
+
+// TestCacheOneSubstitution races goroutines over the same inputs and checks
+// that each input gets one substitution, computed once, whether the cache is
+// unbounded or spills
+func TestCacheOneSubstitution(t *testing.T) {
+	const goroutines, inputs = 16, 2000
+
+	store, err := newSpillStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	spilling := newMaskCache()
+	spilling.limit(32*1024, store, "cache-0")
+
+	for name, c := range map[string]*maskCache{"unbounded": newMaskCache(), "spilling": spilling} {
+		t.Run(name, func(t *testing.T) {
+			var calls atomic.Int64
+			results := make([][]string, goroutines)
+			var wg sync.WaitGroup
+			for g := 0; g < goroutines; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					results[g] = make([]string, inputs)
+					for i := 0; i < inputs; i++ {
+						n := (i + g*inputs/goroutines) % inputs // each goroutine starts elsewhere
+						masked, err := c.loadOrStore("input-"+strconv.Itoa(n), func() (string, error) {
+							return "masked-" + strconv.FormatInt(calls.Add(1), 10), nil
+						})
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						results[g][n] = masked
+					}
+				}(g)
+			}
+			wg.Wait()
+
+			if got := calls.Load(); got != inputs {
+				t.Errorf("mask ran %d times for %d inputs", got, inputs)
+			}
+			for g := 1; g < goroutines; g++ {
+				for n := range results[g] {
+					if results[g][n] != results[0][n] {
+						t.Fatalf("input-%d masked to %q and %q", n, results[0][n], results[g][n])
+					}
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkCacheParallel measures random masking from parallel goroutines;
+// run it with -cpu 1,2,4,8 to see how it scales with GOMAXPROCS
+func BenchmarkCacheParallel(b *testing.B) {
+	const seeded = 100000
+
+	b.Run("hits", func(b *testing.B) {
+		ms := NewMaskingService()
+		for i := 0; i < seeded; i++ {
+			if _, err := ms.Mask("user" + strconv.Itoa(i) + "@example.com"); err != nil {
+				b.Fatal(err)
+			}
+		}
+		var next atomic.Int64
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for i := int(next.Add(seeded / 8)); pb.Next(); i++ {
+				if _, err := ms.Mask("user" + strconv.Itoa(i%seeded) + "@example.com"); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+
+	b.Run("misses", func(b *testing.B) {
+		ms := NewMaskingService()
+		var next atomic.Int64
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if _, err := ms.Mask("user" + strconv.FormatInt(next.Add(1), 10) + "@example.com"); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/xitongsys/parquet-go/parquet"
+)
+
+// fieldKind is how a field appears in an output record
+type fieldKind int
+
+const (
+	leafField fieldKind = iota
+	structField
+	listField
+	mapField
+)
+
+// fieldNode is a field of an output record: a leaf column, or a struct, list
+// or map of further fields. Whether a field is present in a row is read off
+// the definition level of the first leaf column below it, as parquet encodes
+// nested data.
+type fieldNode struct {
+	kind     fieldKind
+	key      []byte       // JSON-encoded `"name":`
+	column   int          // the leaf column, or the first leaf column below
+	def      int32        // definition level at which the field is not null
+	elemDef  int32        // lists and maps: definition level at which they have elements
+	children []*fieldNode // struct fields; the element of a list; the key and value of a map
+}
+
+// flatFields describes columns without nesting (CSV, JSON Lines and flat
+// parquet input) as top-level leaves
+func flatFields(columns []ColumnInfo) ([]*fieldNode, error) {
+	fields := make([]*fieldNode, len(columns))
+	for i, col := range columns {
+		key, err := fieldKey(col.Path)
+		if err != nil {
+			return nil, err
+		}
+		fields[i] = &fieldNode{kind: leafField, key: key, column: i}
+	}
+	return fields, nil
+}
+
+func fieldKey(name string) ([]byte, error) {
+	key, err := json.Marshal(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode column name %s: %w", name, err)
+	}
+	return append(key, ':'), nil
+}
+
+// schemaWalker builds the field tree and leaf paths of a parquet schema from
+// its depth-first element list
+type schemaWalker struct {
+	elements []*parquet.SchemaElement
+	next     int      // index of the next element to visit
+	paths    []string // leaf paths in schema order
+}
+
+// parquetFields returns the top-level fields of a parquet schema and the
+// path of every leaf column. Struct fields are joined with dots and list and
+// map elements are marked with [*], e.g. address.street, phones[*].number or
+// attributes[*].key. Lists nested in other lists are not supported.
+func parquetFields(elements []*parquet.SchemaElement) ([]*fieldNode, []string, error) {
+	w := &schemaWalker{elements: elements, next: 1}
+
+	var fields []*fieldNode
+	for i := int32(0); i < elements[0].GetNumChildren(); i++ {
+		el := elements[w.next]
+		field, err := w.field(el.GetName(), 0, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		fields = append(fields, field)
+	}
+	return fields, w.paths, nil
+}
+
+// field visits the next element, whose field sits below definition level
+// def. inList is set below a repeated field.
+func (w *schemaWalker) field(path string, def int32, inList bool) (*fieldNode, error) {
+	el := w.elements[w.next]
+	w.next++
+
+	key, err := fieldKey(el.GetName())
+	if err != nil {
+		return nil, err
+	}
+
+	switch el.GetRepetitionType() {
+	case parquet.FieldRepetitionType_REPEATED:
+		// A bare repeated field is a required list of itself
+		if inList {
+			return nil, fmt.Errorf("field %s is a list inside another list, which is not supported", path)
+		}
+		node := &fieldNode{kind: listField, key: key, def: def, elemDef: def + 1}
+		elem, err := w.element(el, path+"[*]", def+1)
+		if err != nil {
+			return nil, err
+		}
+		node.column, node.children = elem.column, []*fieldNode{elem}
+		return node, nil
+
+	case parquet.FieldRepetitionType_OPTIONAL:
+		def++
+	}
+
+	if el.GetNumChildren() == 0 {
+		node := &fieldNode{kind: leafField, key: key, column: len(w.paths), def: def}
+		w.paths = append(w.paths, path)
+		return node, nil
+	}
+
+	node := &fieldNode{key: key, def: def}
+	if kind, repeated := w.collection(el); kind != structField {
+		if inList {
+			return nil, fmt.Errorf("field %s is a list inside another list, which is not supported", path)
+		}
+		w.next++
+
+		var elem *fieldNode
+		var err error
+		switch {
+		case kind == mapField:
+			elem, err = w.element(repeated, path+"[*]", def+1)
+		case repeated.GetNumChildren() == 1 && !isLegacyListElement(repeated, el.GetName()):
+			// Three-level list: the repeated group wraps the element field
+			elem, err = w.field(path+"[*]", def+1, true)
+		default:
+			elem, err = w.element(repeated, path+"[*]", def+1)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		node.kind, node.elemDef, node.column = kind, def+1, elem.column
+		if kind == mapField {
+			node.children = elem.children
+		} else {
+			node.children = []*fieldNode{elem}
+		}
+		return node, nil
+	}
+
+	node.kind = structField
+	for i := int32(0); i < el.GetNumChildren(); i++ {
+		child, err := w.field(path+"."+w.elements[w.next].GetName(), def, inList)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			node.column = child.column
+		}
+		node.children = append(node.children, child)
+	}
+	return node, nil
+}
+
+// element visits the fields of repeated element el, already counted in def,
+// as the element of a list: the leaf itself, or a struct of its children
+func (w *schemaWalker) element(el *parquet.SchemaElement, path string, def int32) (*fieldNode, error) {
+	if el.GetNumChildren() == 0 {
+		node := &fieldNode{kind: leafField, column: len(w.paths), def: def}
+		w.paths = append(w.paths, path)
+		return node, nil
+	}
+
+	node := &fieldNode{kind: structField, def: def}
+	for i := int32(0); i < el.GetNumChildren(); i++ {
+		child, err := w.field(path+"."+w.elements[w.next].GetName(), def, true)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			node.column = child.column
+		}
+		node.children = append(node.children, child)
+	}
+	return node, nil
+}
+
+// collection reports whether group el is annotated as a list or map with the
+// single repeated child that holds its elements; other groups are structs
+func (w *schemaWalker) collection(el *parquet.SchemaElement) (fieldKind, *parquet.SchemaElement) {
+	if el.GetNumChildren() != 1 {
+		return structField, nil
+	}
+	repeated := w.elements[w.next]
+	if repeated.GetRepetitionType() != parquet.FieldRepetitionType_REPEATED {
+		return structField, nil
+	}
+
+	lt := el.LogicalType
+	switch {
+	case lt != nil && lt.IsSetLIST(), el.GetConvertedType() == parquet.ConvertedType_LIST:
+		return listField, repeated
+	case lt != nil && lt.IsSetMAP(),
+		el.GetConvertedType() == parquet.ConvertedType_MAP,
+		el.GetConvertedType() == parquet.ConvertedType_MAP_KEY_VALUE:
+		if repeated.GetNumChildren() == 2 {
+			return mapField, repeated
+		}
+	}
+	return structField, nil
+}
+
+// isLegacyListElement recognises the two-level lists some writers produce,
+// where a repeated group named array or <list>_tuple is the element itself
+func isLegacyListElement(repeated *parquet.SchemaElement, listName string) bool {
+	name := repeated.GetName()
+	return name == "array" || name == listName+"_tuple"
+}
+
+// Cell renders row of the column as a single field for flat output (CSV):
+// the value, or for a column inside a list a JSON array of its elements.
+// null reports a null value, or a list whose parent is null.
+func (v *ColumnVector) Cell(row int) (text string, null bool) {
+	if v.Levels == nil || v.Levels.ListDef == 0 {
+		slot, _ := v.slots(row, row+1)
+		return v.String(slot), v.IsNull(slot)
+	}
+
+	slot, n := v.elements(row)
+	if n == 0 && v.def(slot) < v.Levels.ListDef-1 {
+		return "", true
+	}
+
+	elements := make([]*string, n)
+	for k := range elements {
+		if !v.IsNull(slot + k) {
+			s := v.String(slot + k)
+			elements[k] = &s
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(elements) // strings and nils always encode
+	return strings.TrimSuffix(buf.String(), "\n"), false
+}
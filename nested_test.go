@@ -0,0 +1,115 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+type nestedAddress struct {
+	Street *string `parquet:"name=street, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	City   string  `parquet:"name=city, type=BYTE_ARRAY, convertedtype=UTF8"`
+}
+
+type nestedPhone struct {
+	Number string  `parquet:"name=number, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Kind   *string `parquet:"name=kind, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+}
+
+type nestedRow struct {
+	Name    string         `parquet:"name=name, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Address *nestedAddress `parquet:"name=address, repetitiontype=OPTIONAL"`
+	Phones  []nestedPhone  `parquet:"name=phones, type=LIST"`
+	Tags    []string       `parquet:"name=tags, type=LIST, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
+}
+
+func nestedRows() []interface{} {
+	street, home := "Main St", "home"
+	return []interface{}{
+		&nestedRow{Name: "alice", Address: &nestedAddress{Street: &street, City: "Springfield"},
+			Phones: []nestedPhone{{Number: "555-0100", Kind: &home}, {Number: "555-0199"}}, Tags: []string{"a", "b"}},
+		&nestedRow{Name: "bob", Tags: []string{"c"}},
+		&nestedRow{Name: "carol", Address: &nestedAddress{City: "Shelbyville"}, Phones: []nestedPhone{{Number: "555-0142"}}},
+	}
+}
+
+// nestedGolden is nestedRows as JSON Lines, with name redacted
+const nestedGolden = `{"name":"x","address":{"street":"Main St","city":"Springfield"},"phones":[{"number":"555-0100","kind":"home"},{"number":"555-0199","kind":null}],"tags":["a","b"]}
+{"name":"x","address":null,"phones":[],"tags":["c"]}
+{"name":"x","address":{"street":null,"city":"Shelbyville"},"phones":[{"number":"555-0142","kind":null}],"tags":[]}
+`
+
+// redactJob writes input as format with the columns matched by selector
+// redacted to replacement
+func redactJob(t *testing.T, input, format, selector, replacement string) []byte {
+	t.Helper()
+	policy := testPath(t, "policy.yaml")
+	rules := "columns:\n  - column: " + selector + "\n    strategy: redact\n    replacement: " + replacement + "\n"
+	if err := os.WriteFile(policy, []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return runJob(t, parseArgs(t, "-input_path", input, "-output_path", testPath(t, "output."+format),
+		"-output_format", format, "-policy", policy, "-quiet"))
+}
+
+// TestNestedRoundTrip writes optional structs, lists of structs and empty
+// lists through parquet output and checks they read back unchanged
+func TestNestedRoundTrip(t *testing.T) {
+	input := testPath(t, "input.parquet")
+	writeParquetFixture(t, input, new(nestedRow), nestedRows(), 0)
+
+	if got := string(redactJob(t, input, "jsonl", "name", "x")); got != nestedGolden {
+		t.Fatalf("input reads as\n%s\nwant\n%s", got, nestedGolden)
+	}
+
+	output := testPath(t, "output.parquet")
+	if err := os.WriteFile(output, redactJob(t, input, "parquet", "name", "x"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(redactJob(t, output, "jsonl", "name", "x")); got != nestedGolden {
+		t.Errorf("parquet output reads as\n%s\nwant\n%s", got, nestedGolden)
+	}
+}
+
+// TestNestedMaskedLeaf masks a leaf inside a list of structs and checks that
+// the records keep their shape
+func TestNestedMaskedLeaf(t *testing.T) {
+	input := testPath(t, "input.parquet")
+	writeParquetFixture(t, input, new(nestedRow), nestedRows(), 0)
+
+	output := testPath(t, "output.parquet")
+	if err := os.WriteFile(output, redactJob(t, input, "parquet", "phones.number", "'#'"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	want := strings.NewReplacer(`"555-0100"`, `"#"`, `"555-0199"`, `"#"`, `"555-0142"`, `"#"`).Replace(nestedGolden)
+	if got := string(redactJob(t, output, "jsonl", "name", "x")); got != want {
+		t.Errorf("masked output reads as\n%s\nwant\n%s", got, want)
+	}
+
+	csv := string(redactJob(t, output, "csv", "name", "x"))
+	if !strings.Contains(csv, `"[""#"",""#""]"`) {
+		t.Errorf("CSV output lacks the masked list as a JSON array:\n%s", csv)
+	}
+}
+
+type matrixRow struct {
+	Name string     `parquet:"name=name, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Rows []matrixEl `parquet:"name=rows, type=LIST"`
+}
+
+type matrixEl struct {
+	Cells []string `parquet:"name=cells, type=LIST, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
+}
+
+// TestNestedListInListRejected checks that a list inside another list is
+// reported before any output is written
+func TestNestedListInListRejected(t *testing.T) {
+	input := testPath(t, "input.parquet")
+	writeParquetFixture(t, input, new(matrixRow), []interface{}{&matrixRow{Name: "m", Rows: []matrixEl{{Cells: []string{"1"}}}}}, 0)
+
+	_, err := NewRowSource("parquet", input, SourceOptions{})
+	if err == nil || !strings.Contains(err.Error(), "list inside another list") {
+		t.Fatalf("NewRowSource = %v, want a list inside another list error", err)
+	}
+}
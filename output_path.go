@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// defaultOutputTemplate is used inside a directory given as -output_path
+const defaultOutputTemplate = "{input_basename}.masked.{ext}"
+
+var outputPlaceholder = regexp.MustCompile(`\{[^{}]*\}`)
+
+// resolveOutputPath expands -output_path for the given input and output
+// extension. An empty pattern keeps the historical output.<ext> in the working
+// directory; an existing directory (or a pattern ending in a separator) gets
+// defaultOutputTemplate inside it. Placeholders:
+//
+//	{input_basename}  input file name without its extension (data for data.parquet)
+//	{input_name}      input file name with its extension
+//	{input_dir}       directory containing the input file
+//	{ext}             extension of the output format (csv, jsonl, parquet)
+func resolveOutputPath(pattern, inputPath, ext string) (string, error) {
+	if pattern == "" {
+		return "output." + ext, nil
+	}
+
+	if strings.HasSuffix(pattern, "/") || strings.HasSuffix(pattern, string(filepath.Separator)) {
+		pattern = filepath.Join(pattern, defaultOutputTemplate)
+	} else if info, err := os.Stat(pattern); err == nil && info.IsDir() {
+		pattern = filepath.Join(pattern, defaultOutputTemplate)
+	}
+
+	inputName := filepath.Base(inputPath)
+	values := map[string]string{
+		"{input_basename}": strings.TrimSuffix(inputName, filepath.Ext(inputName)),
+		"{input_name}":     inputName,
+		"{input_dir}":      filepath.Dir(inputPath),
+		"{ext}":            ext,
+	}
+
+	var unknown []string
+	outputPath := outputPlaceholder.ReplaceAllStringFunc(pattern, func(placeholder string) string {
+		value, ok := values[placeholder]
+		if !ok {
+			unknown = append(unknown, placeholder)
+		}
+		return value
+	})
+	if len(unknown) > 0 {
+		return "", fmt.Errorf("unknown placeholder %s in output path '%s' (expected {input_basename}, {input_name}, {input_dir} or {ext})", strings.Join(unknown, ", "), pattern)
+	}
+
+	if sameFile(outputPath, inputPath) {
+		return "", fmt.Errorf("output path '%s' would overwrite the input file", outputPath)
+	}
+
+	if dir := filepath.Dir(outputPath); dir != "." {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return "", fmt.Errorf("output directory '%s' does not exist", dir)
+		}
+	}
+
+	return outputPath, nil
+}
+
+// sameFile reports whether two paths name the same file, comparing cleaned
+// absolute paths when the output does not exist yet
+func sameFile(a, b string) bool {
+	ia, errA := os.Stat(a)
+	ib, errB := os.Stat(b)
+	if errA == nil && errB == nil {
+		return os.SameFile(ia, ib)
+	}
+
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
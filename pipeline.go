@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Exit codes returned by the masking and unmask commands
+const (
+	exitOK      = 0
+	exitFailure = 1 // unclassified failure
+	exitUsage   = 2 // invalid flags, policy or column selection
+	exitInput   = 3 // input could not be opened or read
+	exitMasking = 4 // a value could not be masked
+	exitOutput  = 5 // output could not be created, written or finalized
+
+	exitInterrupted = 130 // stopped by SIGINT or SIGTERM after a clean flush
+)
+
+// pipelineStage names the part of a run an error came from
+type pipelineStage string
+
+const (
+	stageConfig pipelineStage = "config"
+	stageInput  pipelineStage = "input"
+	stageMask   pipelineStage = "mask"
+	stageOutput pipelineStage = "output"
+)
+
+var stageExitCodes = map[pipelineStage]int{
+	stageConfig: exitUsage,
+	stageInput:  exitInput,
+	stageMask:   exitMasking,
+	stageOutput: exitOutput,
+}
+
+// stageError tags an error with the stage it came from; the message is the
+// wrapped error's
+type stageError struct {
+	stage pipelineStage
+	err   error
+}
+
+func (e *stageError) Error() string {
+	return e.err.Error()
+}
+
+func (e *stageError) Unwrap() error {
+	return e.err
+}
+
+func newStageError(stage pipelineStage, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &stageError{stage: stage, err: err}
+}
+
+// exitCode maps an error to the process exit code
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+
+	var se *stageError
+	if errors.As(err, &se) {
+		if code, ok := stageExitCodes[se.stage]; ok {
+			return code
+		}
+	}
+	return exitFailure
+}
+
+// stageGroup runs pipeline stages in goroutines. The first stage to fail
+// cancels the shared context so the others stop; Wait returns that first error.
+type stageGroup struct {
+	wg     sync.WaitGroup
+	once   sync.Once
+	err    error
+	cancel context.CancelFunc
+}
+
+func newStageGroup(ctx context.Context) (*stageGroup, context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	return &stageGroup{cancel: cancel}, ctx
+}
+
+func (g *stageGroup) Go(fn func() error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		if err := fn(); err != nil {
+			g.once.Do(func() {
+				g.err = err
+				g.cancel()
+			})
+		}
+	}()
+}
+
+// Wait blocks until every stage has returned
+func (g *stageGroup) Wait() error {
+	g.wg.Wait()
+	g.cancel()
+	return g.err
+}
+
+// errInterrupted is returned by runPipeline when a shutdown signal stopped
+// the reader; everything read before it was masked and written
+var errInterrupted = errors.New("interrupted by signal")
+
+// Batch is a chunk of rows, held column by column in schema order and tagged
+// with its position in input order. Seq numbers of a run are consecutive from
+// 0; batches may travel out of order and are put back in order before the
+// writer.
+type Batch struct {
+	Seq     int64
+	Columns []*ColumnVector
+}
+
+// Len is the number of rows in the batch
+func (b Batch) Len() int {
+	if len(b.Columns) == 0 {
+		return 0
+	}
+	return b.Columns[0].Rows()
+}
+
+// sendChunk delivers batch unless ctx is cancelled first, so a producer never
+// blocks on a consumer that has stopped
+func sendChunk(ctx context.Context, ch chan<- Batch, batch Batch) error {
+	select {
+	case ch <- batch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// seqWindow bounds how far producers may run ahead of the writer: a batch may
+// only be sent once its Seq is within size of the next Seq to be written. This
+// keeps the reorder buffer small without ever blocking the batch it waits for.
+type seqWindow struct {
+	mu      sync.Mutex
+	next    int64
+	size    int64
+	changed chan struct{} // closed and replaced whenever next moves
+}
+
+func newSeqWindow(size int) *seqWindow {
+	return &seqWindow{size: int64(size), changed: make(chan struct{})}
+}
+
+// Wait blocks until seq may be sent. A nil window never blocks.
+func (w *seqWindow) Wait(ctx context.Context, seq int64) error {
+	if w == nil {
+		return nil
+	}
+
+	for {
+		w.mu.Lock()
+		if seq < w.next+w.size {
+			w.mu.Unlock()
+			return nil
+		}
+		changed := w.changed
+		w.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Advance records that every batch before next has been written
+func (w *seqWindow) Advance(next int64) {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.next = next
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
+
+// reorderBuffer holds batches that arrive ahead of their turn
+type reorderBuffer struct {
+	next    int64
+	pending map[int64]Batch
+	window  *seqWindow
+}
+
+func newReorderBuffer(window *seqWindow) *reorderBuffer {
+	return &reorderBuffer{pending: make(map[int64]Batch), window: window}
+}
+
+// Add stores batch and returns the batches that are now ready, in order
+func (rb *reorderBuffer) Add(batch Batch) []Batch {
+	rb.pending[batch.Seq] = batch
+
+	var ready []Batch
+	for {
+		b, ok := rb.pending[rb.next]
+		if !ok {
+			break
+		}
+		delete(rb.pending, rb.next)
+		ready = append(ready, b)
+		rb.next++
+	}
+
+	if len(ready) > 0 {
+		rb.window.Advance(rb.next)
+	}
+	return ready
+}
+
+// Missing reports the first Seq that never arrived when batches are left over
+func (rb *reorderBuffer) Missing() (int64, bool) {
+	return rb.next, len(rb.pending) > 0
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/xitongsys/parquet-go/parquet"
+	"gopkg.in/yaml.v3"
+)
+
+// Policy maps columns to masking strategies. It is loaded from a YAML or JSON
+// file given with -policy; columns that are not listed are passed through.
+// Columns are selected the same way as with -columns (see resolveColumnSelector).
+// Nulls stay null; keep_nulls: false masks them as empty strings instead, for
+// all columns or per entry.
+//
+//	keep_nulls: false
+//	columns:
+//	  - column: last_name
+//	    strategy: substitute
+//	    preserve: [digit]
+//	    domain: surname
+//	  - column: customer_id
+//	    strategy: substitute
+//	    unique: true
+//	  - column: "*_email"
+//	    strategy: hash
+//	    algorithm: hmac-sha256
+//	    truncate: 16
+//	    encoding: base64url
+//	  - column: 4
+//	    strategy: partial
+//	    keep_last: 4
+//	    separators: "- "
+//	  - column: "*_date"
+//	    strategy: date-shift
+//	    entity_column: patient_id
+type Policy struct {
+	KeepNulls *bool          `yaml:"keep_nulls" json:"keep_nulls"` // true when unset
+	Columns   []ColumnPolicy `yaml:"columns" json:"columns"`
+}
+
+// ColumnPolicy configures the strategy for one column. Only the parameters of
+// the selected strategy are used.
+type ColumnPolicy struct {
+	Column    ColumnRef `yaml:"column" json:"column"`
+	Strategy  string    `yaml:"strategy" json:"strategy"`
+	KeepNulls *bool     `yaml:"keep_nulls" json:"keep_nulls"` // overrides the policy-wide setting
+
+	// substitute
+	Preserve []string `yaml:"preserve" json:"preserve"`
+	Domain   string   `yaml:"domain" json:"domain"` // vault domain; defaults to the column selector
+	Unique   bool     `yaml:"unique" json:"unique"` // distinct values get distinct substitutions
+
+	// hash
+	Salt      string `yaml:"salt" json:"salt"`
+	Algorithm string `yaml:"algorithm" json:"algorithm"` // sha256 (default), hmac-sha256 or blake2b
+	KeyFile   string `yaml:"key_file" json:"key_file"`   // key for this column instead of the masking key
+	Truncate  int    `yaml:"truncate" json:"truncate"`   // digest bytes kept
+	Encoding  string `yaml:"encoding" json:"encoding"`   // hex (default), base32 or base64url
+
+	// redact
+	Replacement *string `yaml:"replacement" json:"replacement"`
+
+	// partial and generalize
+	KeepFirst  int     `yaml:"keep_first" json:"keep_first"`
+	KeepLast   int     `yaml:"keep_last" json:"keep_last"`
+	MaskChar   string  `yaml:"mask_char" json:"mask_char"`
+	Fill       string  `yaml:"fill" json:"fill"`             // mask_char (default) or random
+	Separators *string `yaml:"separators" json:"separators"` // kept and not counted; "- ./" when unset
+
+	// fpe
+	Mode        string `yaml:"mode" json:"mode"`
+	Alphabet    string `yaml:"alphabet" json:"alphabet"`
+	Tweak       string `yaml:"tweak" json:"tweak"`
+	ShortValues string `yaml:"short_values" json:"short_values"` // error (default) or substitute
+
+	// date-shift
+	Format       string    `yaml:"format" json:"format"` // Go layout; dates and timestamps are recognised without
+	MaxDays      int       `yaml:"max_days" json:"max_days"`
+	EntityColumn ColumnRef `yaml:"entity_column" json:"entity_column"` // rows with the same entity shift alike
+
+	// generalize
+	Bucket float64 `yaml:"bucket" json:"bucket"`
+}
+
+// ColumnRef identifies columns by zero-based index, name, dotted path or glob
+type ColumnRef string
+
+// UnmarshalJSON accepts both numbers and strings
+func (c *ColumnRef) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*c = ColumnRef(s)
+		return nil
+	}
+
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return fmt.Errorf("column must be a name or an index, got %s", string(data))
+	}
+	*c = ColumnRef(n.String())
+	return nil
+}
+
+const (
+	defaultRedaction  = "REDACTED"
+	defaultMaskChar   = "*"
+	defaultSeparators = "- ./"
+	defaultDateShift  = 30
+)
+
+// LoadPolicy reads a policy file; files ending in .json are parsed as JSON,
+// anything else as YAML. Unknown keys are rejected to catch typos early.
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file %s: %w", path, err)
+	}
+
+	var policy Policy
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&policy)
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&policy)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse policy file %s: %w", path, err)
+	}
+
+	if len(policy.Columns) == 0 {
+		return nil, fmt.Errorf("policy file %s does not list any columns", path)
+	}
+
+	return &policy, nil
+}
+
+// Build validates the policy against the input column names and creates the
+// maskers. All problems are reported together so a policy can be fixed in one go.
+func (p *Policy) Build(columns []ColumnInfo, key []byte) ([]ColumnMasker, error) {
+	var errs []error
+	var maskers []ColumnMasker
+	seen := make(map[int]string)
+	entities := make(map[[2]int]*entityOffsets) // entity column and max_days -> offsets
+
+	for i := range p.Columns {
+		cp := &p.Columns[i]
+
+		indexes, err := resolveColumnSelector(string(cp.Column), columns)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("policy entry %d: %w", i+1, err))
+			continue
+		}
+
+		masker, err := cp.newMasker(key)
+		if err == nil && cp.EntityColumn != "" {
+			err = cp.setEntity(masker, columns, entities)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("policy entry %d (column '%s'): %w", i+1, cp.Column, err))
+			continue
+		}
+
+		keepNulls := p.KeepNulls == nil || *p.KeepNulls
+		if cp.KeepNulls != nil {
+			keepNulls = *cp.KeepNulls
+		}
+
+		// A glob shares one masker across all the columns it matches
+		for _, index := range indexes {
+			if prev, dup := seen[index]; dup {
+				errs = append(errs, fmt.Errorf("policy entry %d: column '%s' is already covered by '%s'", i+1, columns[index].Path, prev))
+				continue
+			}
+			seen[index] = string(cp.Column)
+
+			if masker != nil {
+				maskers = append(maskers, ColumnMasker{Index: index, Masker: masker, KeepNulls: keepNulls})
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return maskers, nil
+}
+
+// setEntity points a date-shift masker at its entity column, which has to be a
+// single column outside any list. Maskers with the same entity column and
+// window share their random offsets, so an entity's dates in different columns
+// move together.
+func (cp *ColumnPolicy) setEntity(masker Masker, columns []ColumnInfo, entities map[[2]int]*entityOffsets) error {
+	dm, ok := masker.(*dateShiftMasker)
+	if !ok {
+		return fmt.Errorf("entity_column only applies to the %s strategy", StrategyDateShift)
+	}
+
+	indexes, err := resolveColumnSelector(string(cp.EntityColumn), columns)
+	if err != nil {
+		return fmt.Errorf("entity_column: %w", err)
+	}
+	if len(indexes) != 1 {
+		return fmt.Errorf("entity_column '%s' matches %d columns, not one", cp.EntityColumn, len(indexes))
+	}
+	if strings.Contains(columns[indexes[0]].Path, "[*]") {
+		return fmt.Errorf("entity_column '%s' is inside a list", cp.EntityColumn)
+	}
+
+	dm.entity = indexes[0]
+	window := [2]int{dm.entity, dm.maxDays}
+	if offsets, ok := entities[window]; ok {
+		dm.offsets = offsets
+	} else {
+		entities[window] = dm.offsets
+	}
+	return nil
+}
+
+// checkParquetTypes rejects maskers whose output can't be written back to
+// the parquet type of their column, which parquet output keeps. Strings take
+// any value; typed columns only take what their strategy keeps in shape.
+func checkParquetTypes(maskers []ColumnMasker, columns []ColumnInfo) error {
+	var errs []error
+	for _, col := range maskers {
+		leaf := columns[col.Index].Leaf
+		if leaf == nil || fitsParquetType(col.Masker, leaf) {
+			continue
+		}
+
+		typeName := leaf.GetType().String()
+		if format := newLogicalFormat(leaf, nil); format != nil && format.kind != logicalInt96 {
+			typeName += " (" + format.kind.String() + ")"
+		}
+		errs = append(errs, fmt.Errorf("column '%s' is %s in parquet output, which %s values don't fit; mask it to csv or jsonl, or choose another strategy",
+			columns[col.Index].Path, typeName, strategyOf(col.Masker)))
+	}
+	return errors.Join(errs...)
+}
+
+// fitsParquetType reports whether every value masker produces parses as leaf
+func fitsParquetType(masker Masker, leaf *parquet.SchemaElement) bool {
+	format := newLogicalFormat(leaf, nil)
+	physical := leaf.GetType()
+	text := format == nil && (physical == parquet.Type_BYTE_ARRAY || physical == parquet.Type_FIXED_LEN_BYTE_ARRAY)
+	integer := format == nil && (physical == parquet.Type_INT32 || physical == parquet.Type_INT64)
+	decimal := format != nil && format.kind == logicalDecimal
+
+	switch m := masker.(type) {
+	case nullMasker:
+		_, err := parquetNull(leaf)
+		return err == nil
+	case redactMasker:
+		_, err := toParquetValue(m.replacement, leaf, format)
+		return err == nil
+	case *dateShiftMasker:
+		return text || (format != nil && (format.kind == logicalDate || format.kind == logicalTimestamp || format.kind == logicalInt96))
+	case *MaskingService:
+		return text || integer || decimal // digits stay digits
+	case *FPEMasker:
+		return text || ((integer || decimal) && string(m.alphabet) == fpeAlphabets["digits"])
+	default:
+		return text
+	}
+}
+
+// strategyOf names the strategy of masker for messages
+func strategyOf(masker Masker) string {
+	switch masker.(type) {
+	case *MaskingService:
+		return StrategySubstitute
+	case hashMasker:
+		return StrategyHash
+	case redactMasker:
+		return StrategyRedact
+	case nullMasker:
+		return StrategyNull
+	case partialMasker:
+		return StrategyPartial
+	case *FPEMasker:
+		return StrategyFPE
+	case *dateShiftMasker:
+		return StrategyDateShift
+	case generalizeMasker:
+		return StrategyGeneralize
+	default:
+		return fmt.Sprintf("%T", masker)
+	}
+}
+
+// newMasker creates the masker for the configured strategy. It returns nil for
+// passthrough so those columns are skipped entirely.
+func (cp *ColumnPolicy) newMasker(key []byte) (Masker, error) {
+	if cp.Unique && !strings.EqualFold(cp.Strategy, StrategySubstitute) {
+		return nil, fmt.Errorf("unique only applies to the %s strategy", StrategySubstitute)
+	}
+
+	switch strings.ToLower(cp.Strategy) {
+	case StrategyPassthrough:
+		return nil, nil
+
+	case StrategySubstitute:
+		preserve, err := parseCharClasses(strings.Join(cp.Preserve, ","))
+		if err != nil {
+			return nil, err
+		}
+		ms := NewMaskingService()
+		if key != nil {
+			ms = NewKeyedMaskingService(key)
+		}
+		ms.PreserveClasses(preserve)
+		ms.domain = cp.Domain
+		if ms.domain == "" {
+			ms.domain = string(cp.Column)
+		}
+		if cp.Unique {
+			ms.RequireUnique()
+		}
+		return ms, nil
+
+	case StrategyHash:
+		// Plain BLAKE2b only takes a key given for the column, so adding a
+		// masking key to a run doesn't change its digests. HMAC-SHA256 gets a
+		// key of its own, as unsalted digests would otherwise equal the MACs
+		// keyed date shifts and substitutions are drawn from.
+		var hashKey []byte
+		if strings.EqualFold(cp.Algorithm, hashHMACSHA256) && key != nil {
+			hashKey = deriveKey(key, "go_masking hash key")
+		}
+		if cp.KeyFile != "" {
+			fileKey, _, err := loadMaskingKey("", cp.KeyFile)
+			if err != nil {
+				return nil, err
+			}
+			hashKey = fileKey
+		}
+		return newHashMasker(cp.Algorithm, []byte(cp.Salt), hashKey, cp.Truncate, cp.Encoding)
+
+	case StrategyRedact:
+		replacement := defaultRedaction
+		if cp.Replacement != nil {
+			replacement = *cp.Replacement
+		}
+		return redactMasker{replacement: replacement}, nil
+
+	case StrategyNull:
+		return nullMasker{}, nil
+
+	case StrategyPartial:
+		if cp.KeepFirst < 0 || cp.KeepLast < 0 {
+			return nil, errors.New("keep_first and keep_last must be non-negative")
+		}
+		maskChar := cp.MaskChar
+		if maskChar == "" {
+			maskChar = defaultMaskChar
+		}
+		if len([]rune(maskChar)) != 1 {
+			return nil, fmt.Errorf("mask_char must be a single character, got '%s'", maskChar)
+		}
+		fill := strings.ToLower(cp.Fill)
+		if fill != "" && fill != fillMaskChar && fill != fillRandom {
+			return nil, fmt.Errorf("unknown fill '%s' (expected %s or %s)", cp.Fill, fillMaskChar, fillRandom)
+		}
+		separators := defaultSeparators
+		if cp.Separators != nil {
+			separators = *cp.Separators
+		}
+		pm := partialMasker{
+			keepFirst:  cp.KeepFirst,
+			keepLast:   cp.KeepLast,
+			maskChar:   []rune(maskChar)[0],
+			separators: separators,
+			randomFill: fill == fillRandom,
+		}
+		if key != nil {
+			// A key of its own, so a random fill tells nothing about the
+			// keyed substitution of the same value
+			pm.key = deriveKey(key, "go_masking partial fill key")
+		}
+		return pm, nil
+
+	case StrategyFPE:
+		if key == nil {
+			return nil, fmt.Errorf("fpe requires -mask_key, -mask_key_file or $%s", maskKeyEnvVar)
+		}
+		mode := FPEMode(strings.ToLower(cp.Mode))
+		if mode == "" {
+			mode = FF1
+		}
+		tweak, err := parseFPETweak(mode, cp.Tweak)
+		if err != nil {
+			return nil, err
+		}
+		alphabet := cp.Alphabet
+		if alphabet == "" {
+			alphabet = "alphanumeric"
+		}
+		short := strings.ToLower(cp.ShortValues)
+		if short != "" && short != fpeShortError && short != fpeShortSubstitute {
+			return nil, fmt.Errorf("unknown short_values '%s' (expected %s or %s)", cp.ShortValues, fpeShortError, fpeShortSubstitute)
+		}
+		fm, err := NewFPEMasker(mode, key, tweak, alphabet)
+		if err != nil {
+			return nil, err
+		}
+		if short == fpeShortSubstitute {
+			fm.SubstituteShortValues()
+		}
+		return fm, nil
+
+	case StrategyDateShift:
+		if cp.MaxDays < 0 {
+			return nil, errors.New("max_days must be non-negative")
+		}
+		maxDays := cp.MaxDays
+		if maxDays == 0 {
+			maxDays = defaultDateShift
+		}
+		var shiftKey []byte
+		if key != nil {
+			shiftKey = deriveKey(key, "go_masking date-shift key")
+		}
+		return newDateShiftMasker(cp.Format, maxDays, shiftKey)
+
+	case StrategyGeneralize:
+		if cp.Bucket < 0 || cp.KeepFirst < 0 {
+			return nil, errors.New("bucket and keep_first must be non-negative")
+		}
+		if cp.Bucket == 0 && cp.KeepFirst == 0 {
+			return nil, errors.New("generalize needs either bucket or keep_first")
+		}
+		return generalizeMasker{bucket: cp.Bucket, keepFirst: cp.KeepFirst}, nil
+
+	case "":
+		return nil, errors.New("strategy is required")
+
+	default:
+		return nil, fmt.Errorf("unknown strategy '%s' (expected one of %s)", cp.Strategy, strings.Join(allStrategies, ", "))
+	}
+}
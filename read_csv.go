@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// CSVSource reads a delimited text file. The first record is the header when
+// CSVHeader is "true", or in "auto" mode when it looks like one; otherwise
+// columns are named column_0, column_1, ... Fields equal to CSVNull are read
+// as nulls, so the tool's own CSV output reads back as it was written.
+type CSVSource struct {
+	path      string
+	opts      SourceOptions
+	schema    *Schema
+	hasHeader bool
+}
+
+func NewCSVSource(filePath string, opts SourceOptions) (*CSVSource, error) {
+	if opts.CSVDelimiter == 0 {
+		opts.CSVDelimiter = ','
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file %s: %w", filePath, err)
+	}
+	defer file.Close()
+
+	reader := newCSVReader(file, opts)
+	reader.FieldsPerRecord = -1 // checked against the header once it is known
+
+	first, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("CSV file %s is empty", filePath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV file %s: %w", filePath, err)
+	}
+
+	var hasHeader bool
+	switch strings.ToLower(opts.CSVHeader) {
+	case "true":
+		hasHeader = true
+	case "false":
+		hasHeader = false
+	case "", "auto":
+		hasHeader = looksLikeHeader(first)
+	default:
+		return nil, fmt.Errorf("invalid CSV header mode '%s' (expected auto, true or false)", opts.CSVHeader)
+	}
+
+	columns := make([]ColumnInfo, len(first))
+	for i, field := range first {
+		name := "column_" + strconv.Itoa(i)
+		if hasHeader {
+			name = strings.TrimSpace(field)
+		}
+		columns[i] = ColumnInfo{Name: name, Path: name}
+	}
+
+	return &CSVSource{
+		path:      filePath,
+		opts:      opts,
+		schema:    &Schema{Columns: columns},
+		hasHeader: hasHeader,
+	}, nil
+}
+
+func newCSVReader(r io.Reader, opts SourceOptions) *csv.Reader {
+	reader := csv.NewReader(r)
+	reader.Comma = opts.CSVDelimiter
+	reader.LazyQuotes = opts.CSVLazyQuotes
+	return reader
+}
+
+// looksLikeHeader treats a record as a header when every field is non-empty,
+// unique and not a number. Files whose first data row is all text need
+// -csv_header to be set explicitly.
+func looksLikeHeader(record []string) bool {
+	seen := make(map[string]bool, len(record))
+	for _, field := range record {
+		field = strings.TrimSpace(field)
+		if field == "" || seen[field] {
+			return false
+		}
+		if _, err := strconv.ParseFloat(field, 64); err == nil {
+			return false
+		}
+		seen[field] = true
+	}
+	return true
+}
+
+func (cs *CSVSource) Schema() *Schema {
+	return cs.schema
+}
+
+func (cs *CSVSource) ReadChunks(ctx context.Context, chunkChan chan<- Batch, chunkSize int, _ *seqWindow) error {
+	defer close(chunkChan)
+
+	file, err := os.Open(cs.path)
+	if err != nil {
+		return fmt.Errorf("failed to open file %s: %w", cs.path, err)
+	}
+	defer file.Close()
+
+	reader := newCSVReader(file, cs.opts)
+	reader.FieldsPerRecord = len(cs.schema.Columns)
+
+	if cs.hasHeader {
+		if _, err := reader.Read(); err != nil {
+			return fmt.Errorf("failed to read CSV header: %w", err)
+		}
+	}
+
+	for skipped := int64(0); skipped < cs.opts.SkipRows; skipped++ {
+		if _, err := reader.Read(); err != nil {
+			return fmt.Errorf("failed to skip %d rows of %s: %w", cs.opts.SkipRows, cs.path, err)
+		}
+	}
+
+	numColumns := len(cs.schema.Columns)
+	batch := Batch{Columns: newStringColumns(numColumns, chunkSize)}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read CSV file %s: %w", cs.path, err)
+		}
+
+		appendRow(batch.Columns, record, cs.opts.CSVNull)
+		if batch.Len() == chunkSize {
+			if err := sendChunk(ctx, chunkChan, batch); err != nil {
+				return err
+			}
+			batch = Batch{Seq: batch.Seq + 1, Columns: newStringColumns(numColumns, chunkSize)}
+		}
+	}
+
+	if batch.Len() > 0 {
+		return sendChunk(ctx, chunkChan, batch)
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// jsonlSchemaSampleLines is how many lines are scanned to discover keys
+const jsonlSchemaSampleLines = 1000
+
+// JSONLSource reads one JSON object per line. Columns are the top-level keys
+// in order of first appearance within the first jsonlSchemaSampleLines lines.
+// Strings are read as their text, numbers and booleans as written, nested
+// objects or arrays as compact JSON; null and missing keys read as nulls. A
+// key whose sampled values all have one JSON type keeps that type in JSON
+// Lines output.
+type JSONLSource struct {
+	path     string
+	schema   *Schema
+	index    map[string]int
+	skipRows int64
+}
+
+// NewJSONLSource infers the schema of filePath; ReadChunks starts after the
+// first skipRows objects
+func NewJSONLSource(filePath string, skipRows int64) (*JSONLSource, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file %s: %w", filePath, err)
+	}
+	defer file.Close()
+
+	var columns []ColumnInfo
+	var typed []bool // a non-null value of the column was sampled
+	index := make(map[string]int)
+
+	reader := bufio.NewReader(file)
+	for lineNumber, sampled := 1, 0; sampled < jsonlSchemaSampleLines; lineNumber++ {
+		line, err := readJSONLine(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", filePath, err)
+		}
+		if line == nil {
+			continue
+		}
+		sampled++
+
+		err = decodeJSONObject(line, func(key string, value json.RawMessage) error {
+			i, ok := index[key]
+			if !ok {
+				i = len(columns)
+				index[key] = i
+				columns = append(columns, ColumnInfo{Name: key, Path: key})
+				typed = append(typed, false)
+			}
+			if isJSONNull(value) {
+				return nil
+			}
+			if t := jsonValueType(value); !typed[i] {
+				columns[i].Type, typed[i] = t, true
+			} else if columns[i].Type != t {
+				columns[i].Type = textValue
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", filePath, lineNumber, err)
+		}
+	}
+
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("JSON Lines file %s has no keys", filePath)
+	}
+
+	return &JSONLSource{path: filePath, schema: &Schema{Columns: columns}, index: index, skipRows: skipRows}, nil
+}
+
+// readJSONLine returns the next line without its newline, or nil for a blank
+// line. Lines have no length limit.
+func readJSONLine(reader *bufio.Reader) ([]byte, error) {
+	line, err := reader.ReadBytes('\n')
+	if err == io.EOF && len(line) > 0 {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return nil, nil
+	}
+	return line, nil
+}
+
+// decodeJSONObject calls fn for each top-level key of a JSON object, keeping
+// the order in which keys are written
+func decodeJSONObject(line []byte, fn func(key string, value json.RawMessage) error) error {
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.UseNumber()
+
+	tok, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		return fmt.Errorf("expected a JSON object, got %v", tok)
+	}
+
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("invalid JSON: %w", err)
+		}
+		key := tok.(string) // object keys are always strings
+
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return fmt.Errorf("invalid JSON value for key %s: %w", key, err)
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	if dec.More() {
+		return fmt.Errorf("unexpected data after JSON object")
+	}
+	return nil
+}
+
+// jsonValueString renders a raw JSON value as a row value; null renders as ""
+// and is told apart by the caller
+func jsonValueString(value json.RawMessage) (string, error) {
+	switch {
+	case len(value) == 0 || isJSONNull(value):
+		return "", nil
+	case value[0] == '"':
+		var s string
+		if err := json.Unmarshal(value, &s); err != nil {
+			return "", err
+		}
+		return s, nil
+	case value[0] == '{' || value[0] == '[':
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, value); err != nil {
+			return "", err
+		}
+		return compact.String(), nil
+	default:
+		return string(value), nil
+	}
+}
+
+// jsonValueType tells the type of a raw JSON value other than null
+func jsonValueType(value json.RawMessage) valueType {
+	switch value[0] {
+	case '"':
+		return textValue
+	case '{', '[':
+		return objectValue
+	case 't', 'f':
+		return boolValue
+	default:
+		return numberValue
+	}
+}
+
+func isJSONNull(value json.RawMessage) bool {
+	return string(value) == "null"
+}
+
+func (js *JSONLSource) Schema() *Schema {
+	return js.schema
+}
+
+func (js *JSONLSource) ReadChunks(ctx context.Context, chunkChan chan<- Batch, chunkSize int, _ *seqWindow) error {
+	defer close(chunkChan)
+
+	file, err := os.Open(js.path)
+	if err != nil {
+		return fmt.Errorf("failed to open file %s: %w", js.path, err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	numColumns := len(js.schema.Columns)
+	batch := Batch{Columns: newStringColumns(numColumns, chunkSize)}
+	row := make([]string, numColumns)
+	present := make([]bool, numColumns) // false for null and missing keys
+	skipped := int64(0)
+
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := readJSONLine(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", js.path, err)
+		}
+		if line == nil {
+			continue
+		}
+		if skipped < js.skipRows {
+			skipped++
+			continue
+		}
+
+		for i := range row {
+			row[i], present[i] = "", false
+		}
+		err = decodeJSONObject(line, func(key string, value json.RawMessage) error {
+			i, ok := js.index[key]
+			if !ok {
+				// dropping the key silently would lose data; make the caller decide
+				return fmt.Errorf("key %s was not seen in the first %d lines (known keys: %s)",
+					key, jsonlSchemaSampleLines, strings.Join(columnNames(js.schema.Columns), ", "))
+			}
+			s, err := jsonValueString(value)
+			if err != nil {
+				return fmt.Errorf("invalid JSON value for key %s: %w", key, err)
+			}
+			row[i], present[i] = s, !isJSONNull(value)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("%s line %d: %w", js.path, lineNumber, err)
+		}
+
+		for i, value := range row {
+			batch.Columns[i].appendString(value, !present[i])
+		}
+		if batch.Len() == chunkSize {
+			if err := sendChunk(ctx, chunkChan, batch); err != nil {
+				return err
+			}
+			batch = Batch{Seq: batch.Seq + 1, Columns: newStringColumns(numColumns, chunkSize)}
+		}
+	}
+
+	if skipped < js.skipRows {
+		return fmt.Errorf("cannot skip %d rows, %s has only %d", js.skipRows, js.path, skipped)
+	}
+
+	if batch.Len() > 0 {
+		return sendChunk(ctx, chunkChan, batch)
+	}
+	return nil
+}
@@ -2,64 +2,262 @@ package main
 
 import (
 	"bytes"
-	"encoding/csv"
+	"context"
 	"fmt"
-	"os"
-	"reflect"
-	"strconv"
+	"strings"
+	"time"
 
 	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/common"
+	"github.com/xitongsys/parquet-go/parquet"
 	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/schema"
 )
 
-func readWriteParquetSchema(filePath string) error {
+// readParquetSchema describes the leaf columns of the parquet file in schema
+// order together with the file metadata. Column names are the header names
+// (last element of the in-memory path, or the full path for nested columns),
+// paths are the original field names joined as described in parquetFields,
+// e.g. address.street or phones[*].number.
+func readParquetSchema(filePath string) (*Schema, error) {
 
 	// reading the first row to get the colums
 	fr, err := local.NewLocalFileReader(filePath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer fr.Close()
 
 	pr, err := reader.NewParquetReader(fr, nil, 4)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer pr.ReadStop()
 
+	// The reader renames schema elements to their in-memory (capitalised)
+	// names; restore the original names so a writer reusing the schema keeps them
+	for i, info := range pr.SchemaHandler.Infos {
+		pr.Footer.Schema[i].Name = info.ExName
+	}
+
+	fields, paths, err := parquetFields(pr.Footer.Schema)
+	if err != nil {
+		return nil, err
+	}
+
 	schemaElements := pr.SchemaHandler.ValueColumns
-	// fmt.Println(schemaElements)
 
-	// writing the schema to the file
-	var columnNamesCsv []string
+	var columns []ColumnInfo
 	delimeter := []byte{0x01}
+	nested := false
 
-	for _, columnName := range schemaElements {
+	for i, columnName := range schemaElements {
 
 		columnNameSplit := bytes.Split([]byte(columnName), delimeter)
-
 		cleanedColName := string(columnNameSplit[len(columnNameSplit)-1])
-		columnNamesCsv = append(columnNamesCsv, cleanedColName)
+
+		// Columns inside structs and lists are named by their full path
+		if len(columnNameSplit) > 2 || strings.HasSuffix(paths[i], "[*]") {
+			cleanedColName = paths[i]
+			nested = true
+		}
+
+		leaf := pr.SchemaHandler.SchemaElements[pr.SchemaHandler.MapIndex[columnName]]
+		columns = append(columns, ColumnInfo{
+			Name: cleanedColName,
+			Path: paths[i],
+			Leaf: leaf,
+			Type: parquetValueType(leaf),
+		})
 	}
 
-	writeFileName := "output.csv"
-	writeFile, err := os.Create(writeFileName)
+	schema := &Schema{Columns: columns, Parquet: pr.Footer}
+	if nested {
+		schema.Fields = fields
+	}
+	return schema, nil
+}
+
+// ParquetSource reads a parquet file; its schema carries the file metadata so
+// parquet output can reuse it
+type ParquetSource struct {
+	path   string
+	schema *Schema
+	opts   SourceOptions
+}
+
+// NewParquetSource reads the schema of filePath; ReadChunks starts after the
+// first opts.SkipRows rows and reads row groups with up to opts.Readers
+// goroutines
+func NewParquetSource(filePath string, opts SourceOptions) (*ParquetSource, error) {
+	schema, err := readParquetSchema(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read parquet schema from %s: %w", filePath, err)
+	}
+	if opts.Readers < 1 {
+		opts.Readers = 1
+	}
+	return &ParquetSource{path: filePath, schema: schema, opts: opts}, nil
+}
+
+func (ps *ParquetSource) Schema() *Schema {
+	return ps.schema
+}
+
+func (ps *ParquetSource) ReadChunks(ctx context.Context, chunkChan chan<- Batch, chunkSize int, window *seqWindow) error {
+	return ReadParquetInChunks(ctx, ps.path, chunkChan, chunkSize, ps.opts, window)
+}
+
+// readerTaskBatches is the most batches one reader task covers. Tasks are
+// handed out in batch order, so readers work side by side within a row group
+// and stay inside the window of batches the writer accepts.
+const readerTaskBatches = 4
+
+// rowGroupTask is the part of one row group a reader sends, as batches
+// firstSeq, firstSeq+1, ...
+type rowGroupTask struct {
+	rowGroup int
+	skip     int64 // rows at the start of the row group before the task
+	rows     int64
+	firstSeq int64
+}
+
+// planRowGroups splits the row groups after the first skipRows rows into
+// tasks of up to readerTaskBatches batches with precomputed batch numbers, so
+// readers can work independently
+func planRowGroups(footer *parquet.FileMetaData, chunkSize int, skipRows int64) ([]rowGroupTask, error) {
+	var tasks []rowGroupTask
+	var start, seq int64
+	taskRows := int64(chunkSize) * readerTaskBatches
+
+	for i, rg := range footer.RowGroups {
+		end := start + rg.NumRows
+		if end > skipRows {
+			skip := int64(0)
+			if skipRows > start {
+				skip = skipRows - start
+			}
+			for ; skip < rg.NumRows; skip += taskRows {
+				rows := min(taskRows, rg.NumRows-skip)
+				tasks = append(tasks, rowGroupTask{rowGroup: i, skip: skip, rows: rows, firstSeq: seq})
+				seq += (rows + int64(chunkSize) - 1) / int64(chunkSize)
+			}
+		}
+		start = end
+	}
+
+	if skipRows > start {
+		return nil, fmt.Errorf("cannot skip %d rows, file has only %d", skipRows, start)
+	}
+	return tasks, nil
+}
+
+// ReadParquetInChunks sends the rows of filePath after the first
+// opts.SkipRows in batches and closes chunkChan when done; it stops early once
+// ctx is cancelled. The tasks of planRowGroups are taken in order by up to
+// opts.Readers goroutines, each with its own file handle, so batches may be
+// sent out of order; every send waits on window first.
+func ReadParquetInChunks(ctx context.Context, filePath string, chunkChan chan<- Batch, chunkSize int, opts SourceOptions, window *seqWindow) error {
+	defer close(chunkChan)
+
+	footer, err := readParquetFooter(filePath)
 	if err != nil {
 		return err
 	}
-	defer writeFile.Close()
 
-	writer := csv.NewWriter(writeFile)
-	defer writer.Flush()
+	tasks, err := planRowGroups(footer, chunkSize, opts.SkipRows)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filePath, err)
+	}
+
+	readers := opts.Readers
+	if readers > len(tasks) {
+		readers = len(tasks)
+	}
 
-	if err := writer.Write(columnNamesCsv); err != nil {
-		panic(err)
+	queue := make(chan rowGroupTask, len(tasks))
+	for _, task := range tasks {
+		queue <- task
 	}
+	close(queue)
 
-	return nil
+	g, ctx := newStageGroup(ctx)
+	for r := 0; r < readers; r++ {
+		g.Go(func() error {
+			return readRowGroups(ctx, filePath, queue, chunkChan, chunkSize, opts.Timezone, window)
+		})
+	}
+	return g.Wait()
 }
 
-func ReadParquetInChunks(filePath string, chunkChan chan<- [][]string, chunkSize int) error {
+func readParquetFooter(filePath string) (*parquet.FileMetaData, error) {
+	fr, err := local.NewLocalFileReader(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer fr.Close()
+
+	pr, err := reader.NewParquetReader(fr, nil, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer pr.ReadStop()
+
+	return pr.Footer, nil
+}
+
+// parquetLeaf is a leaf column as parquet-go addresses it
+type parquetLeaf struct {
+	path    string // in-memory path, as in SchemaHandler.ValueColumns
+	name    string // dotted original path, for error messages
+	typ     parquet.Type
+	format  *logicalFormat
+	nested  bool  // inside a struct or list, so read with its levels
+	maxDef  int32 // definition level of a value
+	listDef int32 // definition level of a list element; 0 outside lists
+}
+
+// parquetLeaves lists the leaf columns in schema order, with timestamps
+// rendered in loc. Lists nested in other lists are not supported.
+func parquetLeaves(sh *schema.SchemaHandler, loc *time.Location) ([]parquetLeaf, error) {
+	leaves := make([]parquetLeaf, len(sh.ValueColumns))
+	for i, path := range sh.ValueColumns {
+		name := path
+		if exPath, ok := sh.InPathToExPath[path]; ok {
+			name = strings.Join(common.StrToPath(exPath)[1:], ".")
+		}
+
+		el := sh.SchemaElements[sh.MapIndex[path]]
+		leaf := parquetLeaf{path: path, name: name, typ: el.GetType(), format: newLogicalFormat(el, loc)}
+
+		// Levels count the optional and repeated fields along the path
+		segments := common.StrToPath(path)
+		leaf.nested = len(segments) > 2
+		for j := 2; j <= len(segments); j++ {
+			rt, err := sh.GetRepetitionType(segments[:j])
+			if err != nil {
+				return nil, err
+			}
+			if rt == parquet.FieldRepetitionType_REQUIRED {
+				continue
+			}
+			leaf.maxDef++
+			if rt == parquet.FieldRepetitionType_REPEATED {
+				if leaf.listDef > 0 {
+					return nil, fmt.Errorf("column %s is a list inside another list, which is not supported", name)
+				}
+				leaf.listDef, leaf.nested = leaf.maxDef, true
+			}
+		}
+		leaves[i] = leaf
+	}
+	return leaves, nil
+}
+
+// readRowGroups reads tasks from queue with one reader, a column at a time.
+// A task later in the row group the reader is in skips ahead from where the
+// reader is, which only decodes page headers and levels.
+func readRowGroups(ctx context.Context, filePath string, queue <-chan rowGroupTask, chunkChan chan<- Batch, chunkSize int, loc *time.Location, window *seqWindow) error {
 	fr, err := local.NewLocalFileReader(filePath)
 	if err != nil {
 		return err
@@ -72,79 +270,98 @@ func ReadParquetInChunks(filePath string, chunkChan chan<- [][]string, chunkSize
 	}
 	defer pr.ReadStop()
 
-	num := int(pr.GetNumRows())
-	batch := make([][]string, 0, chunkSize)
+	leaves, err := parquetLeaves(pr.SchemaHandler, loc)
+	if err != nil {
+		return err
+	}
 
-	for i := 0; i < num; i += chunkSize {
-		readSize := chunkSize
-		if i+chunkSize > num {
-			readSize = num - i
+	rowGroups := pr.Footer.RowGroups
+	current, pos := -1, int64(0) // row group of pr and rows of it consumed
+	for task := range queue {
+		if task.rowGroup != current || task.skip < pos {
+			if err := selectRowGroup(pr, rowGroups, task.rowGroup); err != nil {
+				return fmt.Errorf("failed to open row group %d: %w", task.rowGroup, err)
+			}
+			current, pos = task.rowGroup, 0
 		}
-
-		data, err := pr.ReadByNumber(readSize)
-		if err != nil {
-			return err
+		if task.skip > pos {
+			if err := pr.SkipRows(task.skip - pos); err != nil {
+				return fmt.Errorf("failed to skip %d rows of row group %d: %w", task.skip-pos, task.rowGroup, err)
+			}
 		}
+		pos = task.skip + task.rows
+
+		seq := task.firstSeq
+		for read := int64(0); read < task.rows; read += int64(chunkSize) {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			readSize := int64(chunkSize)
+			if read+readSize > task.rows {
+				readSize = task.rows - read
+			}
 
-		batch = batch[:0] // Reset batch slice but keep capacity
-		for _, row := range data {
-			csvRow, err := SchemaLossless(row)
+			batch, err := readColumns(pr, leaves, readSize)
 			if err != nil {
+				return fmt.Errorf("row group %d: %w", task.rowGroup, err)
+			}
+			batch.Seq = seq
+
+			if err := window.Wait(ctx, seq); err != nil {
+				return err
+			}
+			if err := sendChunk(ctx, chunkChan, batch); err != nil {
 				return err
 			}
-			batch = append(batch, csvRow)
+			seq++
 		}
-
-		// Send a copy of the batch to avoid race conditions
-		batchCopy := make([][]string, len(batch))
-		copy(batchCopy, batch)
-		chunkChan <- batchCopy
 	}
-	close(chunkChan)
 	return nil
 }
 
-func SchemaLossless(row interface{}) ([]string, error) {
-
-	// Reflect on the interface to discover its underlying type and value.
-	val := reflect.ValueOf(row)
-
-	// If the underlying value is a pointer, we need to get the value that the pointer points to.
-	if val.Kind() == reflect.Ptr {
-		val = val.Elem()
-	}
-	// Make sure we now have a struct type after dereferencing any pointer.
-	if val.Kind() != reflect.Struct {
-		panic("Item is not a struct")
-	}
-
-	var csvRow []string
-	for j := 0; j < val.NumField(); j++ {
-		field := val.Field(j)
-		// We need to check if the field is an exported field (capitalized name).
-		if field.CanInterface() {
-			switch field.Kind() {
-			case reflect.String:
-				csvRow = append(csvRow, field.String())
-			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-				csvRow = append(csvRow, strconv.FormatInt(field.Int(), 10))
-			case reflect.Float32, reflect.Float64:
-				csvRow = append(csvRow, strconv.FormatFloat(field.Float(), 'f', -1, 64))
-			case reflect.Bool:
-				csvRow = append(csvRow, strconv.FormatBool(field.Bool()))
-			// Add more cases as needed for other types.
-			default:
-				// If it's a pointer, we need to check if it's nil.
-				if field.Kind() == reflect.Ptr && !field.IsNil() {
-					// Recursively process the field by dereferencing the pointer.
-					csvRow = append(csvRow, fmt.Sprintf("%v", field.Elem().Interface()))
-				} else {
-					// For all other types, use fmt.Sprintf to convert to a string.
-					csvRow = append(csvRow, fmt.Sprintf("%v", field.Interface()))
-				}
-			}
+// readColumns reads the next rows rows of every leaf column
+func readColumns(pr *reader.ParquetReader, leaves []parquetLeaf, rows int64) (Batch, error) {
+	columns := make([]*ColumnVector, len(leaves))
+	for i, leaf := range leaves {
+		values, rls, dls, err := pr.ReadColumnByPath(leaf.path, rows)
+		if err != nil {
+			return Batch{}, fmt.Errorf("failed to read column %s: %w", leaf.name, err)
+		}
+
+		vec, err := newParquetVector(values, leaf.typ, leaf.format)
+		if err != nil {
+			return Batch{}, fmt.Errorf("column %s: %w", leaf.name, err)
+		}
+		if leaf.nested {
+			vec.Levels = newColumnLevels(dls, rls, leaf.maxDef, leaf.listDef)
 		}
 
+		// parquet-go drops page errors and returns what it could read
+		if int64(vec.Rows()) != rows {
+			return Batch{}, fmt.Errorf("column %s: read %d rows, expected %d", leaf.name, vec.Rows(), rows)
+		}
+		columns[i] = vec
 	}
-	return csvRow, nil
+	return Batch{Columns: columns}, nil
+}
+
+// selectRowGroup points every column buffer of pr at the start of one row
+// group by giving it a footer that lists only that group
+func selectRowGroup(pr *reader.ParquetReader, rowGroups []*parquet.RowGroup, index int) error {
+	footer := *pr.Footer
+	footer.RowGroups = rowGroups[index : index+1]
+
+	for path, cb := range pr.ColumnBuffers {
+		if cb != nil {
+			cb.PFile.Close()
+		}
+
+		buffer, err := reader.NewColumnBuffer(pr.PFile, &footer, pr.SchemaHandler, path)
+		if err != nil {
+			return err
+		}
+		pr.ColumnBuffers[path] = buffer
+	}
+	return nil
 }
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+)
+
+type readerRow struct {
+	ID   int64  `parquet:"name=id, type=INT64"`
+	Name string `parquet:"name=name, type=BYTE_ARRAY, convertedtype=UTF8"`
+	City string `parquet:"name=city, type=BYTE_ARRAY, convertedtype=UTF8"`
+}
+
+// TestReadersKeepRowOrder checks that parallel row-group readers write the
+// same output as a single reader, over row groups that don't line up with
+// the batches
+func TestReadersKeepRowOrder(t *testing.T) {
+	const rowCount = 20000
+	input := testPath(t, "input.parquet")
+	rows := make([]interface{}, rowCount)
+	for i := range rows {
+		rows[i] = &readerRow{ID: int64(i), Name: fmt.Sprintf("name-%05d", i), City: fmt.Sprintf("city-%d", i%97)}
+	}
+	writeParquetFixture(t, input, new(readerRow), rows, 8*1024)
+
+	footer, err := readParquetFooter(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(footer.RowGroups) < 10 {
+		t.Fatalf("fixture has %d row groups, want at least 10", len(footer.RowGroups))
+	}
+
+	output := func(readers int) []byte {
+		return runJob(t, &AppConfig{
+			InputPath:     input,
+			InputFormat:   "parquet",
+			OutputFile:    testPath(t, "output.csv"),
+			OutputFormat:  "csv",
+			ColumnsToMask: []string{"name"},
+			ChunkSize:     700,
+			Readers:       readers,
+			MaskKey:       []byte("secret"),
+		})
+	}
+
+	single := output(1)
+	if lines := bytes.Count(single, []byte("\n")); lines != rowCount+1 {
+		t.Fatalf("single reader wrote %d lines, want %d", lines, rowCount+1)
+	}
+	if parallel := output(4); !bytes.Equal(parallel, single) {
+		t.Error("output with 4 readers differs from the output with 1 reader")
+	}
+}
+
+// writeLargeRowGroups writes 40,000 rows in row groups of well over a window
+// of batches of 100 rows each
+func writeLargeRowGroups(t testing.TB) (string, int) {
+	const rowCount = 40000
+	input := testPath(t, "input.parquet")
+	rows := make([]interface{}, rowCount)
+	for i := range rows {
+		rows[i] = &readerRow{ID: int64(i), Name: fmt.Sprintf("name-%05d", i), City: fmt.Sprintf("city-%d", i%97)}
+	}
+	writeParquetFixture(t, input, new(readerRow), rows, 256*1024)
+
+	footer, err := readParquetFooter(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(footer.RowGroups) < 2 || footer.RowGroups[0].NumRows < 50*100 {
+		t.Fatalf("fixture has %d row groups, the first of %d rows; want at least 2 of 5000 rows", len(footer.RowGroups), footer.RowGroups[0].NumRows)
+	}
+	return input, rowCount
+}
+
+// readAll reads input with readers readers as the pipeline does, through a
+// window and a reorder buffer, and returns the ids in the order they come out
+func readAll(t testing.TB, input string, readers int) []int64 {
+	window := newSeqWindow(readers * readerTaskBatches)
+	reorder := newReorderBuffer(window)
+	chunks := make(chan Batch)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- ReadParquetInChunks(context.Background(), input, chunks, 100, SourceOptions{Readers: readers}, window)
+	}()
+
+	var ids []int64
+	for batch := range chunks {
+		for _, ready := range reorder.Add(batch) {
+			for i := 0; i < ready.Len(); i++ {
+				ids = append(ids, ready.Columns[0].Int64s[i])
+			}
+		}
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+// TestReadersShareRowGroups checks that readers split large row groups between
+// them in batch order, rather than one reader taking a whole group while the
+// others wait on the window, and that rows still come out in order
+func TestReadersShareRowGroups(t *testing.T) {
+	input, rowCount := writeLargeRowGroups(t)
+
+	footer, err := readParquetFooter(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tasks, err := planRowGroups(footer, 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seq int64
+	for _, task := range tasks {
+		if task.firstSeq != seq || task.rows > 100*readerTaskBatches {
+			t.Fatalf("task %+v: want batches from %d, at most %d of them", task, seq, readerTaskBatches)
+		}
+		seq += (task.rows + 99) / 100
+	}
+	if perGroup := len(tasks) / len(footer.RowGroups); perGroup < 4 {
+		t.Fatalf("%d tasks for %d row groups; readers can't share a group", len(tasks), len(footer.RowGroups))
+	}
+
+	for _, readers := range []int{1, 3} {
+		ids := readAll(t, input, readers)
+		if len(ids) != rowCount {
+			t.Fatalf("%d readers read %d rows, want %d", readers, len(ids), rowCount)
+		}
+		for i, id := range ids {
+			if id != int64(i) {
+				t.Fatalf("%d readers: row %d has id %d", readers, i, id)
+			}
+		}
+	}
+}
+
+// BenchmarkReaders reads row groups far larger than the window of batches;
+// run it with -cpu to see readers overlap within a row group
+func BenchmarkReaders(b *testing.B) {
+	input, _ := writeLargeRowGroups(b)
+	for _, readers := range []int{1, 2, 4} {
+		b.Run(fmt.Sprintf("readers=%d", readers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				readAll(b, input, readers)
+			}
+		})
+	}
+}
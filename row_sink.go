@@ -0,0 +1,341 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// RowSink is an output destination for masked rows. The pipeline opens it
+// with the input schema, writes batches and flushes periodically, then either
+// closes it on success or aborts it on failure so no partial output is left.
+// Nothing appears at the output path until Close succeeds.
+type RowSink interface {
+	Open(schema *Schema) error
+	WriteBatch(batch Batch) error
+	Flush() error
+	Close() error
+	Abort() error
+}
+
+// ResumableSink is a RowSink that can report how much it has written and
+// continue output left by an earlier run
+type ResumableSink interface {
+	RowSink
+
+	// CanResume reports whether the format can be appended to at all
+	CanResume() bool
+
+	// Position returns the file currently being written and its size as of
+	// the last Flush (the final path once closed)
+	Position() (path string, size int64, err error)
+
+	// Resume opens the sink with the first size bytes of an earlier output at
+	// path instead of starting empty; path itself is left untouched
+	Resume(schema *Schema, path string, size int64) error
+
+	// Detach closes and syncs the sink but keeps the temporary file, outside
+	// the output path, for a later Resume
+	Detach() error
+}
+
+// SinkOptions carries format-specific command-line settings
+type SinkOptions struct {
+	ParquetCodec string
+	CSVNull      string // written for null values in CSV output
+}
+
+type sinkFactory func(path string, opts SinkOptions) RowSink
+
+// sinkFormats maps -output_format values to sinks. The format name doubles as
+// the default file extension. New formats only need an entry here.
+var sinkFormats = map[string]sinkFactory{
+	"csv": func(path string, opts SinkOptions) RowSink {
+		return &writerSink{path: path, open: func(path string, schema *Schema) (fileRowWriter, error) {
+			return openCSVWriter(path, schema, opts.CSVNull)
+		}, reopen: func(path string, _ *Schema) (fileRowWriter, error) {
+			csvWriter, err := NewCSVWriter(path) // appends; the header is already there
+			if err != nil {
+				return nil, err
+			}
+			csvWriter.nullToken = opts.CSVNull
+			return csvWriter, nil
+		}}
+	},
+	"jsonl": func(path string, _ SinkOptions) RowSink {
+		open := func(path string, schema *Schema) (fileRowWriter, error) {
+			return NewJSONLWriter(path, schema)
+		}
+		return &writerSink{path: path, open: open, reopen: open}
+	},
+	"parquet": func(path string, opts SinkOptions) RowSink {
+		return &writerSink{path: path, open: func(path string, schema *Schema) (fileRowWriter, error) {
+			footer := schema.Parquet
+			if footer == nil {
+				footer = stringParquetSchema(schema.Columns)
+			}
+			return NewParquetWriter(path, footer, opts.ParquetCodec)
+		}}
+	},
+}
+
+// NewRowSink creates the sink registered for format
+func NewRowSink(format, path string, opts SinkOptions) (RowSink, error) {
+	factory, ok := sinkFormats[strings.ToLower(format)]
+	if !ok {
+		return nil, fmt.Errorf("unknown output format '%s' (expected one of %s)", format, strings.Join(sinkFormatNames(), ", "))
+	}
+	return factory(path, opts), nil
+}
+
+func sinkFormatNames() []string {
+	names := make([]string, 0, len(sinkFormats))
+	for name := range sinkFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// fileRowWriter is implemented by CSVWriter, JSONLWriter and ParquetWriter
+type fileRowWriter interface {
+	WriteColumnsNoFlush(columns []*ColumnVector) error
+	Flush() error
+	Close() error
+	DeleteOutputFile() error
+}
+
+// writerSink adapts a fileRowWriter to RowSink. The writer is created by open
+// once the schema is known and writes to a temporary file next to path; Close
+// fsyncs and renames it into place, so path only ever holds complete output.
+// Abort may be called from any goroutine to discard the output.
+type writerSink struct {
+	mu      sync.Mutex
+	path    string
+	tmpPath string
+	open    func(path string, schema *Schema) (fileRowWriter, error)
+	reopen  func(path string, schema *Schema) (fileRowWriter, error) // appends to existing output; nil if the format can't
+	writer  fileRowWriter
+	done    bool // closed or aborted
+}
+
+// openCSVWriter creates the CSV output and writes the header row
+func openCSVWriter(path string, schema *Schema, nullToken string) (fileRowWriter, error) {
+	csvWriter, err := NewCSVWriter(path)
+	if err != nil {
+		return nil, err
+	}
+	csvWriter.nullToken = nullToken
+
+	if err := csvWriter.Write(columnNames(schema.Columns)); err != nil {
+		csvWriter.DeleteOutputFile()
+		return nil, fmt.Errorf("failed to write CSV header: %w", err)
+	}
+
+	return csvWriter, nil
+}
+
+func (ws *writerSink) Open(schema *Schema) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if ws.writer != nil || ws.done {
+		return errors.New("sink is already open")
+	}
+
+	tmpPath, err := ws.createTemp()
+	if err != nil {
+		return err
+	}
+
+	writer, err := ws.open(tmpPath, schema)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	ws.tmpPath = tmpPath
+	ws.writer = writer
+	return nil
+}
+
+// createTemp creates the empty temporary output in the target directory so
+// the final rename is atomic
+func (ws *writerSink) createTemp() (string, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(ws.path), "."+filepath.Base(ws.path)+".*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary output file: %w", err)
+	}
+	tmp.Close()
+	os.Chmod(tmp.Name(), 0644)
+	return tmp.Name(), nil
+}
+
+// Resume copies the first size bytes of path into a new temporary file and
+// appends from there, so the earlier output survives if this run fails too
+func (ws *writerSink) Resume(schema *Schema, path string, size int64) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if !ws.CanResume() {
+		return errors.New("this output format cannot be resumed")
+	}
+	if ws.writer != nil || ws.done {
+		return errors.New("sink is already open")
+	}
+
+	tmpPath, err := ws.createTemp()
+	if err != nil {
+		return err
+	}
+
+	if err := copyPrefix(path, tmpPath, size); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to copy earlier output %s: %w", path, err)
+	}
+
+	writer, err := ws.reopen(tmpPath, schema)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	ws.tmpPath = tmpPath
+	ws.writer = writer
+	return nil
+}
+
+func copyPrefix(srcPath, dstPath string, size int64) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.CopyN(dst, src, size); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+func (ws *writerSink) CanResume() bool {
+	return ws.reopen != nil
+}
+
+func (ws *writerSink) Position() (string, int64, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if ws.writer == nil {
+		return "", 0, errors.New("sink is not open")
+	}
+
+	path := ws.tmpPath
+	if ws.done {
+		path = ws.path
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", 0, err
+	}
+	return path, info.Size(), nil
+}
+
+func (ws *writerSink) WriteBatch(batch Batch) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if ws.writer == nil || ws.done {
+		return errors.New("sink is not open")
+	}
+	return ws.writer.WriteColumnsNoFlush(batch.Columns)
+}
+
+func (ws *writerSink) Flush() error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if ws.writer == nil || ws.done {
+		return errors.New("sink is not open")
+	}
+	return ws.writer.Flush()
+}
+
+// Close finalizes the writer, fsyncs the temporary file and renames it to the
+// output path. On any error the temporary file is removed.
+func (ws *writerSink) Close() error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if ws.writer == nil || ws.done {
+		return nil
+	}
+	ws.done = true
+
+	if err := ws.writer.Close(); err != nil {
+		os.Remove(ws.tmpPath)
+		return err
+	}
+
+	if err := syncFile(ws.tmpPath); err != nil {
+		os.Remove(ws.tmpPath)
+		return fmt.Errorf("failed to sync output file: %w", err)
+	}
+
+	if err := os.Rename(ws.tmpPath, ws.path); err != nil {
+		os.Remove(ws.tmpPath)
+		return fmt.Errorf("failed to move output into place: %w", err)
+	}
+
+	// Persist the rename itself; the data is already durable, so a directory
+	// that can't be synced (some network filesystems) is not an error
+	syncFile(filepath.Dir(ws.path))
+	return nil
+}
+
+// Abort closes the writer and removes the partial output
+func (ws *writerSink) Abort() error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if ws.writer == nil || ws.done {
+		return nil
+	}
+	ws.done = true
+	return ws.writer.DeleteOutputFile()
+}
+
+func (ws *writerSink) Detach() error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if ws.writer == nil || ws.done {
+		return nil
+	}
+	ws.done = true
+	if err := ws.writer.Close(); err != nil {
+		return err
+	}
+	return syncFile(ws.tmpPath)
+}
+
+func syncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RowSource is an input for the masking pipeline. Schema is known as soon as
+// the source is created, so policies can be validated before any row is read.
+type RowSource interface {
+	Schema() *Schema
+
+	// ReadChunks sends the rows in batches of at most chunkSize, numbered from
+	// Seq 0, and closes chunkChan when it returns, whether or not it failed.
+	// It stops with ctx.Err() once ctx is cancelled. Sources that send
+	// batches out of order wait on window before each send.
+	ReadChunks(ctx context.Context, chunkChan chan<- Batch, chunkSize int, window *seqWindow) error
+}
+
+// SourceOptions carries format-specific command-line settings
+type SourceOptions struct {
+	CSVDelimiter  rune
+	CSVHeader     string // auto, true or false
+	CSVLazyQuotes bool
+	CSVNull       string         // CSV fields read as null; "" makes empty fields null
+	SkipRows      int64          // rows already processed by a resumed run
+	Readers       int            // parallel parquet row-group readers
+	Timezone      *time.Location // zone parquet timestamps are rendered in; nil is UTC
+}
+
+type sourceFactory func(path string, opts SourceOptions) (RowSource, error)
+
+// sourceFormats maps -input_format values to sources. New formats only need
+// an entry here (and an extension in sourceExtensions for auto-detection).
+var sourceFormats = map[string]sourceFactory{
+	"parquet": func(path string, opts SourceOptions) (RowSource, error) {
+		return NewParquetSource(path, opts)
+	},
+	"csv": func(path string, opts SourceOptions) (RowSource, error) {
+		return NewCSVSource(path, opts)
+	},
+	"jsonl": func(path string, opts SourceOptions) (RowSource, error) {
+		return NewJSONLSource(path, opts.SkipRows)
+	},
+}
+
+// sourceExtensions is used by the "auto" format; anything else is parquet
+var sourceExtensions = map[string]string{
+	".csv":    "csv",
+	".tsv":    "csv",
+	".jsonl":  "jsonl",
+	".ndjson": "jsonl",
+}
+
+// NewRowSource opens path with the given format ("auto" picks it from the
+// file extension)
+func NewRowSource(format, path string, opts SourceOptions) (RowSource, error) {
+	format = strings.ToLower(format)
+	if format == "" || format == "auto" {
+		format = detectSourceFormat(path)
+	}
+
+	factory, ok := sourceFormats[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown input format '%s' (expected auto or one of %s)", format, strings.Join(sourceFormatNames(), ", "))
+	}
+	return factory(path, opts)
+}
+
+func detectSourceFormat(path string) string {
+	if format, ok := sourceExtensions[strings.ToLower(filepath.Ext(path))]; ok {
+		return format
+	}
+	return "parquet"
+}
+
+func sourceFormatNames() []string {
+	names := make([]string, 0, len(sourceFormats))
+	for name := range sourceFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseDelimiter accepts a single character or the names "tab", "comma",
+// "semicolon" and "pipe"
+func parseDelimiter(s string) (rune, error) {
+	switch strings.ToLower(s) {
+	case "", "comma":
+		return ',', nil
+	case "tab", `\t`:
+		return '\t', nil
+	case "semicolon":
+		return ';', nil
+	case "pipe":
+		return '|', nil
+	}
+
+	runes := []rune(s)
+	if len(runes) != 1 || runes[0] == '"' || runes[0] == '\r' || runes[0] == '\n' {
+		return 0, fmt.Errorf("invalid delimiter '%s' (expected a single character other than a quote or newline)", s)
+	}
+	return runes[0], nil
+}
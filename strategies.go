@@ -0,0 +1,389 @@
+package main
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// Masking strategy names accepted in the policy file
+const (
+	StrategySubstitute  = "substitute"
+	StrategyHash        = "hash"
+	StrategyRedact      = "redact"
+	StrategyNull        = "null"
+	StrategyPartial     = "partial"
+	StrategyFPE         = "fpe"
+	StrategyDateShift   = "date-shift"
+	StrategyGeneralize  = "generalize"
+	StrategyPassthrough = "passthrough"
+)
+
+var allStrategies = []string{
+	StrategySubstitute, StrategyHash, StrategyRedact, StrategyNull, StrategyPartial,
+	StrategyFPE, StrategyDateShift, StrategyGeneralize, StrategyPassthrough,
+}
+
+// redactMasker replaces every value with a fixed string
+type redactMasker struct {
+	replacement string
+}
+
+func (rm redactMasker) Mask(value string) (string, error) {
+	return rm.replacement, nil
+}
+
+// nullMasker blanks every value
+type nullMasker struct{}
+
+func (nullMasker) Mask(value string) (string, error) {
+	return "", nil
+}
+
+// hashMasker replaces a value with a one-way digest of salt || value, so
+// the same value always gives the same pseudonym without storing a mapping.
+// The digest is SHA-256, HMAC-SHA-256 or BLAKE2b-256 (keyed when given a
+// key), optionally truncated to its first truncate bytes, and encoded as
+// text.
+type hashMasker struct {
+	newHash  func() hash.Hash
+	salt     []byte
+	truncate int // bytes of the digest kept; 0 keeps all
+	encode   func([]byte) string
+}
+
+// Hash algorithms and digest encodings accepted in the policy file
+const (
+	hashSHA256     = "sha256"
+	hashHMACSHA256 = "hmac-sha256"
+	hashBLAKE2b    = "blake2b"
+
+	encodingHex       = "hex"
+	encodingBase32    = "base32"
+	encodingBase64URL = "base64url"
+)
+
+// minHashTruncate is the shortest digest kept: below 8 bytes distinct values
+// of a column of a few million rows are likely to share a pseudonym
+const minHashTruncate = 8
+
+var digestEncodings = map[string]func([]byte) string{
+	encodingHex:       hex.EncodeToString,
+	encodingBase32:    base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString,
+	encodingBase64URL: base64.RawURLEncoding.EncodeToString,
+}
+
+// newHashMasker checks the hash settings of a policy entry. hmac-sha256 needs
+// key; blake2b is keyed when key is set and plain otherwise.
+func newHashMasker(algorithm string, salt, key []byte, truncate int, encoding string) (hashMasker, error) {
+	hm := hashMasker{salt: salt, truncate: truncate}
+
+	switch strings.ToLower(algorithm) {
+	case "", hashSHA256:
+		hm.newHash = sha256.New
+	case hashHMACSHA256:
+		if key == nil {
+			return hm, fmt.Errorf("%s requires key_file, -mask_key, -mask_key_file or $%s", hashHMACSHA256, maskKeyEnvVar)
+		}
+		hm.newHash = func() hash.Hash { return hmac.New(sha256.New, key) }
+	case hashBLAKE2b:
+		if len(key) > blake2b.Size {
+			return hm, fmt.Errorf("%s keys are at most %d bytes, got %d", hashBLAKE2b, blake2b.Size, len(key))
+		}
+		if _, err := blake2b.New256(key); err != nil {
+			return hm, err
+		}
+		hm.newHash = func() hash.Hash {
+			h, _ := blake2b.New256(key) // the key was checked above
+			return h
+		}
+	default:
+		return hm, fmt.Errorf("unknown algorithm '%s' (expected %s, %s or %s)", algorithm, hashSHA256, hashHMACSHA256, hashBLAKE2b)
+	}
+
+	if size := hm.newHash().Size(); truncate < 0 || truncate > size || truncate > 0 && truncate < minHashTruncate {
+		return hm, fmt.Errorf("truncate must be between %d and %d bytes (0 keeps the whole digest), got %d", minHashTruncate, size, truncate)
+	}
+
+	if encoding == "" {
+		encoding = encodingHex
+	}
+	encode, ok := digestEncodings[strings.ToLower(encoding)]
+	if !ok {
+		return hm, fmt.Errorf("unknown encoding '%s' (expected %s, %s or %s)", encoding, encodingHex, encodingBase32, encodingBase64URL)
+	}
+	hm.encode = encode
+
+	return hm, nil
+}
+
+func (hm hashMasker) Mask(value string) (string, error) {
+	h := hm.newHash()
+	h.Write(hm.salt)
+	h.Write([]byte(value))
+	digest := h.Sum(nil)
+	if hm.truncate > 0 {
+		digest = digest[:hm.truncate]
+	}
+	return hm.encode(digest), nil
+}
+
+// partialMasker keeps the first and last characters of a value and replaces
+// the ones in between with maskChar, or with random characters of the same
+// class when randomFill is set (keyed by the value when key is set).
+// Separator characters are kept and don't count towards keepFirst and
+// keepLast, so 4111-1111-1111-1234 can become XXXX-XXXX-XXXX-1234.
+type partialMasker struct {
+	keepFirst  int
+	keepLast   int
+	maskChar   rune
+	separators string
+	randomFill bool
+	key        []byte
+}
+
+// Partial fill modes accepted in the policy file
+const (
+	fillMaskChar = "mask_char"
+	fillRandom   = "random"
+)
+
+func (pm partialMasker) Mask(value string) (string, error) {
+	runes := []rune(value)
+	n := 0 // characters that are not separators
+	for _, r := range runes {
+		if !strings.ContainsRune(pm.separators, r) {
+			n++
+		}
+	}
+
+	var src intSource
+	if pm.randomFill {
+		src = randSource{}
+		if pm.key != nil {
+			src = newKeyStream(pm.key, value)
+		}
+	}
+
+	k := 0
+	for i, r := range runes {
+		if strings.ContainsRune(pm.separators, r) {
+			continue
+		}
+		if k >= pm.keepFirst && k < n-pm.keepLast {
+			runes[i] = pm.fill(r, src)
+		}
+		k++
+	}
+	return string(runes), nil
+}
+
+// fill is the replacement for r: a random character of its class, or the
+// mask character for fixed fill and characters without a class
+func (pm partialMasker) fill(r rune, src intSource) rune {
+	if src != nil {
+		if _, pool, ok := classifyRune(r); ok {
+			return pool[src.Intn(len(pool))]
+		}
+	}
+	return pm.maskChar
+}
+
+// dateShiftMasker parses a date or timestamp with layout, or with the first
+// of dateShiftLayouts that fits when layout is empty, and moves it by a whole
+// number of days in [-maxDays, maxDays]. With a key the offset is derived from
+// the value, so the same date always shifts the same way; otherwise it is
+// random. With an entity column the offset is derived from the entity of the
+// row instead, with the key or a random one drawn for the run, so the
+// intervals between an entity's dates are kept. Rows whose entity is null
+// belong to no entity and have each date shifted on its own.
+type dateShiftMasker struct {
+	layout  string
+	maxDays int
+	key     []byte
+	entity  int            // column holding the entity key; -1 for none
+	offsets *entityOffsets // run key for random offsets per entity
+}
+
+// dateShiftLayouts are tried in turn by date-shift without a format; parquet
+// dates and timestamps are rendered in one of them
+var dateShiftLayouts = []string{
+	time.RFC3339Nano,
+	localDateTimeLayout,
+	time.DateTime + ".999999999",
+	time.DateOnly,
+}
+
+// entityOffsets holds the key random offsets per entity are derived from. It
+// is drawn for the run rather than remembering an offset for each entity, so
+// memory doesn't grow with the entities and a checkpoint only stores the key,
+// not the entity values.
+type entityOffsets struct {
+	mu      sync.Mutex
+	key     []byte
+	changes *stateJournal // the key, until a checkpoint has stored it
+}
+
+// entityKeyState is the name the run key is checkpointed under
+const entityKeyState = "key"
+
+func newDateShiftMasker(layout string, maxDays int, key []byte) (*dateShiftMasker, error) {
+	runKey := make([]byte, 32)
+	if _, err := crand.Read(runKey); err != nil {
+		return nil, fmt.Errorf("drawing date-shift key: %w", err)
+	}
+	return &dateShiftMasker{
+		layout:  layout,
+		maxDays: maxDays,
+		key:     key,
+		entity:  -1,
+		offsets: &entityOffsets{key: runKey},
+	}, nil
+}
+
+func (dm *dateShiftMasker) Mask(value string) (string, error) {
+	return dm.shift(value, value, false)
+}
+
+// relatedColumn implements rowMasker
+func (dm *dateShiftMasker) relatedColumn() int {
+	return dm.entity
+}
+
+// MaskRow shifts value by the offset of entity
+func (dm *dateShiftMasker) MaskRow(value, entity string) (string, error) {
+	return dm.shift(value, entity, true)
+}
+
+// shift moves value by the offset of seed, which is the value itself or the
+// entity of its row
+func (dm *dateShiftMasker) shift(value, seed string, byEntity bool) (string, error) {
+	if value == "" {
+		return value, nil
+	}
+
+	t, layout, err := dm.parse(value)
+	if err != nil {
+		return "", err
+	}
+	return t.AddDate(0, 0, dm.offset(seed, byEntity)).Format(layout), nil
+}
+
+func (dm *dateShiftMasker) parse(value string) (time.Time, string, error) {
+	if dm.layout != "" {
+		t, err := time.Parse(dm.layout, value)
+		if err != nil {
+			return t, "", fmt.Errorf("cannot parse %s as a date with layout '%s'", describeValue(value), dm.layout)
+		}
+		return t, dm.layout, nil
+	}
+
+	for _, layout := range dateShiftLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, layout, nil
+		}
+	}
+	return time.Time{}, "", fmt.Errorf("cannot parse %s as a date or timestamp; set format to its layout", describeValue(value))
+}
+
+func (dm *dateShiftMasker) offset(seed string, byEntity bool) int {
+	span := 2*dm.maxDays + 1
+	key := dm.key
+	if key == nil {
+		if !byEntity {
+			return rand.Intn(span) - dm.maxDays
+		}
+		dm.offsets.mu.Lock()
+		key = dm.offsets.key
+		dm.offsets.mu.Unlock()
+	}
+
+	return newKeyStream(key, seed).Intn(span) - dm.maxDays
+}
+
+// Stateful reports whether the offsets are random per entity, so a resumed
+// run needs the run key
+func (dm *dateShiftMasker) Stateful() bool {
+	return dm.key == nil && dm.entity >= 0
+}
+
+// TrackChanges records the run key for the next Changes. Maskers sharing
+// their offsets share the record too.
+func (dm *dateShiftMasker) TrackChanges() {
+	dm.offsets.mu.Lock()
+	defer dm.offsets.mu.Unlock()
+	if dm.offsets.changes == nil {
+		dm.offsets.changes = newStateJournal()
+		dm.offsets.changes.add(entityKeyState, hex.EncodeToString(dm.offsets.key))
+	}
+}
+
+// Changes returns the run key the first time it is called, then nothing
+func (dm *dateShiftMasker) Changes() map[string]string {
+	return dm.offsets.changes.take()
+}
+
+// Restore takes the run key of an earlier run; it must be called before
+// masking starts
+func (dm *dateShiftMasker) Restore(state map[string]string) error {
+	dm.offsets.mu.Lock()
+	defer dm.offsets.mu.Unlock()
+	for name, value := range state {
+		key, err := hex.DecodeString(value)
+		if name != entityKeyState || err != nil || len(key) != len(dm.offsets.key) {
+			return fmt.Errorf("restoring date-shift offsets: unexpected state entry '%s'", name)
+		}
+		dm.offsets.key = key
+		// A checkpoint not yet written would otherwise record this run's key
+		dm.offsets.changes.add(entityKeyState, value)
+	}
+	return nil
+}
+
+// describeValue names value in an error without revealing it, as errors go
+// to the console and app.log while the value is still unmasked
+func describeValue(value string) string {
+	return fmt.Sprintf("a %d-character value", len([]rune(value)))
+}
+
+// generalizeMasker reduces precision: numbers are replaced by the bucket they
+// fall into ("30-40" for 34 with bucket 10), strings are truncated to keepFirst
+// characters
+type generalizeMasker struct {
+	bucket    float64
+	keepFirst int
+}
+
+func (gm generalizeMasker) Mask(value string) (string, error) {
+	if value == "" {
+		return value, nil
+	}
+
+	if gm.bucket > 0 {
+		v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return "", fmt.Errorf("cannot generalize %s: it is not a number", describeValue(value))
+		}
+		lo := math.Floor(v/gm.bucket) * gm.bucket
+		return strconv.FormatFloat(lo, 'f', -1, 64) + "-" + strconv.FormatFloat(lo+gm.bucket, 'f', -1, 64), nil
+	}
+
+	runes := []rune(value)
+	if len(runes) > gm.keepFirst {
+		runes = runes[:gm.keepFirst]
+	}
+	return string(runes), nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newPartial(t *testing.T, cp ColumnPolicy, key []byte) Masker {
+	t.Helper()
+	cp.Strategy = StrategyPartial
+	m, err := cp.newMasker(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestPartialSeparators(t *testing.T) {
+	none := ""
+	tests := []struct {
+		name string
+		cp   ColumnPolicy
+		in   string
+		want string
+	}{
+		{"default separators", ColumnPolicy{KeepLast: 4, MaskChar: "X"}, "4111-1111-1111-1234", "XXXX-XXXX-XXXX-1234"},
+		{"default separators", ColumnPolicy{KeepFirst: 1, KeepLast: 2}, "j.doe/01 22", "j.***/** 22"},
+		{"no separators", ColumnPolicy{KeepLast: 4, MaskChar: "X", Separators: &none}, "4111-1111-1111-1234", "XXXXXXXXXXXXXXX1234"},
+		{"short value", ColumnPolicy{KeepFirst: 2, KeepLast: 4}, "12-3", "12-3"},
+	}
+	for _, tt := range tests {
+		if got, err := newPartial(t, tt.cp, nil).Mask(tt.in); err != nil || got != tt.want {
+			t.Errorf("%s: Mask(%q) = %q, %v; want %q", tt.name, tt.in, got, err, tt.want)
+		}
+	}
+}
+
+// TestPartialKeyedFill checks that a keyed random fill repeats for a value
+// but doesn't draw the same characters as keyed substitution
+func TestPartialKeyedFill(t *testing.T) {
+	key := []byte("mask key")
+	pm := newPartial(t, ColumnPolicy{Fill: fillRandom}, key)
+
+	const value = "4111111111111234"
+	first, err := pm.Mask(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := pm.Mask(value); again != first {
+		t.Errorf("keyed fill gave %s, then %s", first, again)
+	}
+	if substituted, _ := NewKeyedMaskingService(key).Mask(value); substituted == first {
+		t.Errorf("keyed fill and keyed substitution both give %s", first)
+	}
+}
+
+func TestHashTruncate(t *testing.T) {
+	for truncate, wantLen := range map[int]int{0: 64, 8: 16, 32: 64} {
+		hm, err := newHashMasker(hashSHA256, nil, nil, truncate, encodingHex)
+		if err != nil {
+			t.Fatalf("truncate %d: %v", truncate, err)
+		}
+		if got, _ := hm.Mask("alice@example.com"); len(got) != wantLen {
+			t.Errorf("truncate %d gives %q, want %d hex digits", truncate, got, wantLen)
+		}
+	}
+	for _, truncate := range []int{-1, 1, 7, 33} {
+		if _, err := newHashMasker(hashSHA256, nil, nil, truncate, encodingHex); err == nil {
+			t.Errorf("truncate %d was accepted", truncate)
+		}
+	}
+}
+
+// TestHashKeySeparate checks that HMAC-SHA256 digests under the masking key
+// aren't the MACs keyed date-shift and substitution draw from for the value
+func TestHashKeySeparate(t *testing.T) {
+	key := []byte("mask key")
+	cp := ColumnPolicy{Strategy: StrategyHash, Algorithm: hashHMACSHA256}
+	hm, err := cp.newMasker(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const value = "2024-01-15"
+	digest, err := hm.Mask(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := func(parts ...[]byte) string {
+		h := hmac.New(sha256.New, key)
+		for _, p := range parts {
+			h.Write(p)
+		}
+		return hex.EncodeToString(h.Sum(nil))
+	}
+	if digest == mac([]byte(value)) {
+		t.Error("digest is the MAC of the value under the masking key, as date-shift draws from")
+	}
+	if digest == mac([]byte{0, 0, 0, 0}, []byte(value)) {
+		t.Error("digest is the first block of the keyed substitution stream")
+	}
+}
+
+type visitRow struct {
+	Patient *string `parquet:"name=patient, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	Visit   string  `parquet:"name=visit, type=BYTE_ARRAY, convertedtype=UTF8"`
+}
+
+// TestDateShiftByEntity checks that an entity's dates shift alike, keeping
+// their intervals, and that rows without an entity aren't shifted as one
+func TestDateShiftByEntity(t *testing.T) {
+	patient := "p1"
+	rows := []interface{}{&visitRow{Patient: &patient, Visit: "2024-01-10"}, &visitRow{Patient: &patient, Visit: "2024-01-20"}}
+	for i := 0; i < 40; i++ {
+		rows = append(rows, &visitRow{Visit: "2024-01-10"})
+	}
+	input := testPath(t, "input.parquet")
+	writeParquetFixture(t, input, new(visitRow), rows, 0)
+
+	policy := testPath(t, "policy.yaml")
+	rules := "columns:\n  - column: visit\n    strategy: date-shift\n    entity_column: patient\n"
+	if err := os.WriteFile(policy, []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	out := runJob(t, parseArgs(t, "-input_path", input, "-output_path", testPath(t, "output.csv"), "-policy", policy, "-quiet"))
+
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")[1:]
+	date := func(line string) time.Time {
+		d, err := time.Parse(time.DateOnly, strings.Split(line, ",")[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	if gap := date(lines[1]).Sub(date(lines[0])); gap != 10*24*time.Hour {
+		t.Errorf("p1's visits are %v apart after shifting, want 240h", gap)
+	}
+
+	shifted := make(map[string]bool)
+	for _, line := range lines[2:] {
+		shifted[line] = true
+	}
+	if len(shifted) == 1 {
+		t.Errorf("all 40 rows without a patient shifted to %s", lines[2])
+	}
+}
+
+// TestDateShiftState checks that the checkpoint state of random offsets per
+// entity holds no entity values and restores the same offsets
+func TestDateShiftState(t *testing.T) {
+	newMasker := func() *dateShiftMasker {
+		dm, err := newDateShiftMasker("", 30, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dm.entity = 0
+		dm.TrackChanges()
+		return dm
+	}
+
+	first := newMasker()
+	before := make([]string, 20)
+	for i := range before {
+		before[i], _ = first.MaskRow("2024-01-10", "patient-"+strconv.Itoa(i))
+	}
+	state := first.Changes()
+	for name, value := range state {
+		if strings.Contains(name, "patient") || strings.Contains(value, "patient") {
+			t.Errorf("state %q: %q names an entity", name, value)
+		}
+	}
+
+	resumed := newMasker()
+	if err := resumed.Restore(state); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range before {
+		if got, _ := resumed.MaskRow("2024-01-10", "patient-"+strconv.Itoa(i)); got != want {
+			t.Errorf("patient-%d shifted to %s before the checkpoint and %s after", i, want, got)
+		}
+	}
+}
+
+// TestMaskErrorsHideValues checks that a value a strategy can't mask isn't
+// repeated in the error, which is logged
+func TestMaskErrorsHideValues(t *testing.T) {
+	const secret = "jane.doe@example.com"
+	maskers := map[string]Masker{
+		"generalize":             generalizeMasker{bucket: 10},
+		"date-shift":             &dateShiftMasker{maxDays: 30, entity: -1},
+		"date-shift with format": &dateShiftMasker{layout: time.DateOnly, maxDays: 30, entity: -1},
+	}
+	for name, m := range maskers {
+		_, err := m.Mask(secret)
+		if err == nil {
+			t.Errorf("%s masked %s", name, secret)
+		} else if strings.Contains(err.Error(), "jane") {
+			t.Errorf("%s error %q shows the value", name, err)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/maphash"
+	"math"
+	"slices"
+	"sync"
+)
+
+// maxRedraws is how often unique masking draws again for one value before it
+// falls back to searching the substitution space
+const maxRedraws = 100
+
+// maxEnumerated is the largest substitution space that is searched in full
+const maxEnumerated = 1 << 20
+
+// reverseEntrySize approximates the memory an index entry costs: its two
+// hashes and their map slot
+const reverseEntrySize = 48
+
+// reverseIndex records which input each substitution of a unique masker went
+// to. It holds 64-bit hashes rather than the strings to stay small: two
+// substitutions sharing a hash only cost a needless redraw. A bounded index
+// moves the entries of a full shard to a spill store, or forgets them when a
+// vault keeps the owners of its tokens instead.
+type reverseIndex struct {
+	seed   maphash.Seed
+	shards [cacheShards]reverseShard
+	store  *spillStore
+	bucket string
+}
+
+type reverseShard struct {
+	mu         sync.Mutex
+	owners     map[uint64]uint64 // hash of the substitution -> hash of its input
+	maxEntries int               // 0 is unbounded
+	evicted    int               // entries moved to the store or forgotten
+}
+
+func newReverseIndex() *reverseIndex {
+	ri := &reverseIndex{seed: maphash.MakeSeed()}
+	for i := range ri.shards {
+		ri.shards[i].owners = make(map[uint64]uint64)
+	}
+	return ri
+}
+
+// limit bounds the index to maxBytes, moving the entries of a full shard to
+// bucket of store, or forgetting them when store is nil. It must be called
+// before the index is used.
+func (ri *reverseIndex) limit(maxBytes int64, store *spillStore, bucket string) {
+	ri.store, ri.bucket = store, bucket
+	maxEntries := max(1, int(maxBytes/cacheShards/reverseEntrySize))
+	for i := range ri.shards {
+		ri.shards[i].maxEntries = maxEntries
+	}
+}
+
+// claim records masked as the substitution of input and reports false when
+// it already belongs to another input; it only fails when the spill store
+// can't be read or written
+func (ri *reverseIndex) claim(masked, input string) (bool, error) {
+	mh, ih := maphash.String(ri.seed, masked), maphash.String(ri.seed, input)
+	sh := &ri.shards[mh&(cacheShards-1)]
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if owner, ok := sh.owners[mh]; ok {
+		return owner == ih, nil
+	}
+	if sh.evicted > 0 && ri.store != nil {
+		owner, ok, err := ri.store.read(ri.bucket, hashKey(mh))
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			return owner == hashKey(ih), nil
+		}
+	}
+
+	sh.owners[mh] = ih
+	if sh.maxEntries > 0 && len(sh.owners) > sh.maxEntries {
+		return true, ri.evict(sh)
+	}
+	return true, nil
+}
+
+// evict empties a full shard into the store, if there is one; sh.mu must be
+// held
+func (ri *reverseIndex) evict(sh *reverseShard) error {
+	if ri.store != nil {
+		entries := make(map[string]string, len(sh.owners))
+		for mh, ih := range sh.owners {
+			entries[hashKey(mh)] = hashKey(ih)
+		}
+		if err := ri.store.write(ri.bucket, entries); err != nil {
+			return err
+		}
+	}
+	sh.evicted += len(sh.owners)
+	sh.owners = make(map[uint64]uint64)
+	return nil
+}
+
+// hashKey is how a hash is kept in the spill store
+func hashKey(h uint64) string {
+	return string(binary.BigEndian.AppendUint64(nil, h))
+}
+
+// size is the number of substitutions handed out
+func (ri *reverseIndex) size() int {
+	n := 0
+	for i := range ri.shards {
+		sh := &ri.shards[i]
+		sh.mu.Lock()
+		n += len(sh.owners) + sh.evicted
+		sh.mu.Unlock()
+	}
+	return n
+}
+
+// substitutionSpace is how many substitutions input has: the product of the
+// pool sizes of its substituted characters, capped at math.MaxUint64
+func substitutionSpace(input string, preserve map[CharClass]bool) uint64 {
+	space := uint64(1)
+	for _, ch := range input {
+		class, pool, ok := classifyRune(ch)
+		if !ok || preserve[class] {
+			continue
+		}
+		if space > math.MaxUint64/uint64(len(pool)) {
+			return math.MaxUint64
+		}
+		space *= uint64(len(pool))
+	}
+	return space
+}
+
+// redraw picks the next candidate after the draws-th collision of input: a
+// fresh draw at first, then, when the substitution space is small enough,
+// every substitution in turn, so one is found as long as any is left
+func (ms *MaskingService) redraw(input, token string, src intSource, draws int) (string, error) {
+	if draws < maxRedraws {
+		return ms.substitute(input, src), nil
+	}
+
+	space := substitutionSpace(input, ms.preserve)
+	if space <= maxEnumerated && uint64(draws-maxRedraws) < space {
+		return ms.nextSubstitution(input, token), nil
+	}
+	return "", ms.collisionError(input, space)
+}
+
+// nextSubstitution steps token to the following substitution of input,
+// counting through the substituted characters like an odometer
+func (ms *MaskingService) nextSubstitution(input, token string) string {
+	in, out := []rune(input), []rune(token)
+	for i := len(out) - 1; i >= 0; i-- {
+		class, pool, ok := classifyRune(in[i])
+		if !ok || ms.preserve[class] {
+			continue
+		}
+		if j := slices.Index(pool, out[i]) + 1; j < len(pool) {
+			out[i] = pool[j]
+			break
+		}
+		out[i] = pool[0] // and carry on to the next character
+	}
+	return string(out)
+}
+
+// collisionError explains why no unused substitution was found for input
+// without revealing the value
+func (ms *MaskingService) collisionError(input string, space uint64) error {
+	reason := fmt.Sprintf("all %d substitutions of values of its form are taken", space)
+	if space > maxEnumerated {
+		reason = fmt.Sprintf("%d draws among %d possible substitutions all collided", maxRedraws, space)
+	}
+	return fmt.Errorf("unique masking found no unused substitution for a %d-character value: %s (%d values masked so far); preserve fewer character classes or drop unique for this column",
+		len([]rune(input)), reason, ms.unique.size())
+}
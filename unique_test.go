@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+)
+
+// TestUniqueRestoreClaims resumes keyed unique masking over single digits,
+// which have only ten substitutions, and checks that the substitutions
+// restored from the first run aren't handed out again
+func TestUniqueRestoreClaims(t *testing.T) {
+	key := []byte("mask key")
+	newService := func() *MaskingService {
+		ms := NewKeyedMaskingService(key)
+		ms.RequireUnique()
+		ms.TrackChanges()
+		return ms
+	}
+
+	first := newService()
+	if !first.Stateful() {
+		t.Fatal("keyed unique masking isn't checkpointed")
+	}
+	seen := make(map[string]string)
+	for i := 0; i < 5; i++ {
+		masked, err := first.Mask(strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[masked] = strconv.Itoa(i)
+	}
+
+	resumed := newService()
+	if err := resumed.Restore(first.Changes()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 5; i < 10; i++ {
+		masked, err := resumed.Mask(strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if owner, ok := seen[masked]; ok {
+			t.Fatalf("%d and %s both masked to %s", i, owner, masked)
+		}
+		seen[masked] = strconv.Itoa(i)
+	}
+}
+
+// TestUniqueBoundedIndex masks five-digit values, where keyed draws often
+// collide, under a limit that moves most of the reverse index to the spill
+// store, and checks that results stay distinct and repeat for evicted inputs
+func TestUniqueBoundedIndex(t *testing.T) {
+	ms := NewKeyedMaskingService([]byte("mask key"))
+	ms.RequireUnique()
+	columns := []ColumnMasker{{Masker: ms}}
+
+	if _, err := limitCaches(columns, 64*1024, ""); err == nil {
+		t.Fatal("bounded unique masking without a spill directory or vault was accepted")
+	}
+	caches, err := limitCaches(columns, 64*1024, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer caches.Close()
+
+	const n = 20000
+	inputs := make([]string, n)
+	masked := make(map[string]string, n)
+	for i := range inputs {
+		inputs[i] = fmt.Sprintf("%05d", i*5)
+		out, err := ms.Mask(inputs[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if owner, ok := masked[out]; ok {
+			t.Fatalf("%s and %s both masked to %s", owner, inputs[i], out)
+		}
+		masked[out] = inputs[i]
+	}
+	if size := ms.unique.size(); size != n {
+		t.Errorf("index holds %d results, want %d", size, n)
+	}
+	if held := len(ms.unique.shards[0].owners); held > n/cacheShards/2 {
+		t.Errorf("a shard keeps %d results in memory; the limit doesn't hold", held)
+	}
+
+	for i := 0; i < n; i += 97 {
+		out, err := ms.Mask(inputs[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if masked[out] != inputs[i] {
+			t.Errorf("%s masked to %s, which went to %s", inputs[i], out, masked[out])
+		}
+	}
+}
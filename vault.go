@@ -0,0 +1,723 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// vaultBatchSize is how many new tokens are collected before they are
+// written to the vault in one transaction
+const vaultBatchSize = 10000
+
+// vaultCheck is sealed into every vault so a wrong key is caught on open
+const vaultCheck = "go_masking token vault"
+
+var (
+	vaultMetaBucket    = []byte("meta")
+	vaultDomainsBucket = []byte("domains")
+	vaultOwnersBucket  = []byte("owners")
+	vaultCheckKey      = []byte("check")
+)
+
+// tokenVault persists the substitutions of random masking in a bbolt file so
+// that separate runs, e.g. over a customers and an orders file, give a value
+// the same pseudonym. Substitutions are kept per column domain. Inputs are
+// only stored as HMAC-SHA256 lookup keys and pseudonyms are sealed with
+// AES-256-GCM, so the file reveals neither without the vault key. Each
+// token's lookup key is also recorded under the token's own lookup key, so
+// unique masking can tell which tokens are taken.
+type tokenVault struct {
+	*sealer
+	path      string
+	db        *bolt.DB
+	lookupKey []byte
+
+	mu            sync.Mutex
+	pending       map[vaultRef]string // new tokens not yet written
+	pendingOwners map[vaultRef]string // their owners, by token lookup key
+	added         int64
+}
+
+// vaultRef locates an entry: its domain and lookup key
+type vaultRef struct {
+	domain, lookup string
+}
+
+// vaultDomain is the part of a vault one masking service reads and fills
+type vaultDomain struct {
+	vault *tokenVault
+	name  string
+}
+
+// loadVaultKey reads the vault secret from a file; trailing newlines are
+// ignored
+func loadVaultKey(keyFile string) ([]byte, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vault key file %s: %w", keyFile, err)
+	}
+	key := strings.TrimRight(string(data), "\r\n")
+	if key == "" {
+		return nil, fmt.Errorf("vault key file %s is empty", keyFile)
+	}
+	return []byte(key), nil
+}
+
+// deriveVaultKey turns the vault secret into a key for one purpose
+func deriveVaultKey(secret []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("go_masking vault " + purpose))
+	return mac.Sum(nil)
+}
+
+// openVault opens or creates the vault at path. It fails if the vault was
+// created with a different secret or another run has it open.
+func openVault(path string, secret []byte) (*tokenVault, error) {
+	sealer, err := newSealer(deriveVaultKey(secret, "aes-256-gcm key"))
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("vault %s is in use by another run", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open vault %s: %w", path, err)
+	}
+
+	v := &tokenVault{
+		sealer:        sealer,
+		path:          path,
+		db:            db,
+		lookupKey:     deriveVaultKey(secret, "lookup key"),
+		pending:       make(map[vaultRef]string),
+		pendingOwners: make(map[vaultRef]string),
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		domains, err := tx.CreateBucketIfNotExists(vaultDomainsBucket)
+		if err != nil {
+			return err
+		}
+		meta, err := tx.CreateBucketIfNotExists(vaultMetaBucket)
+		if err != nil {
+			return err
+		}
+
+		check := meta.Get(vaultCheckKey)
+		if check == nil {
+			sealed, err := v.seal([]byte(vaultCheck), vaultCheckKey)
+			if err != nil {
+				return err
+			}
+			if err := meta.Put(vaultCheckKey, sealed); err != nil {
+				return err
+			}
+		} else if err := v.verifyCheck(check); err != nil {
+			return err
+		}
+
+		if tx.Bucket(vaultOwnersBucket) != nil {
+			return nil
+		}
+		owners, err := tx.CreateBucket(vaultOwnersBucket)
+		if err != nil {
+			return err
+		}
+		return v.indexOwners(domains, owners)
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("vault %s: %w", path, err)
+	}
+	return v, nil
+}
+
+// sealer encrypts records with AES-256-GCM. The vault seals its tokens with
+// it, checkpoints the state of random maskers and the cache spill store its
+// entries.
+type sealer struct {
+	aead cipher.AEAD
+}
+
+func newSealer(key []byte) (*sealer, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{aead: aead}, nil
+}
+
+// seal encrypts plaintext bound to aad; the nonce is prepended
+func (s *sealer) seal(plaintext, aad []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(plaintext)+s.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("generating nonce: %w", err)
+	}
+	return s.aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func (s *sealer) open(sealed, aad []byte) ([]byte, error) {
+	n := s.aead.NonceSize()
+	if len(sealed) < n {
+		return nil, errors.New("sealed value is too short")
+	}
+	return s.aead.Open(nil, sealed[:n], sealed[n:], aad)
+}
+
+func (v *tokenVault) verifyCheck(check []byte) error {
+	plain, err := v.open(check, vaultCheckKey)
+	if err != nil || string(plain) != vaultCheck {
+		return errors.New("key does not match the one the vault was created with")
+	}
+	return nil
+}
+
+// tokenAAD binds a sealed token to its domain and lookup key, so tokens
+// can't be moved between inputs or domains unnoticed
+func tokenAAD(domain string, lookup []byte) []byte {
+	return append([]byte(domain+"\x00"), lookup...)
+}
+
+// indexOwners records the owner of every token in domains, for vaults made
+// before owners were kept. Where an older vault gave two inputs the same
+// token, the first one found owns it.
+func (v *tokenVault) indexOwners(domains, owners *bolt.Bucket) error {
+	return domains.ForEachBucket(func(name []byte) error {
+		b, err := owners.CreateBucketIfNotExists(name)
+		if err != nil {
+			return err
+		}
+		return domains.Bucket(name).ForEach(func(lookup, sealed []byte) error {
+			token, err := v.open(sealed, tokenAAD(string(name), lookup))
+			if err != nil {
+				return fmt.Errorf("token in domain '%s' can't be decrypted: %w", name, err)
+			}
+			tokenLookup := []byte(v.lookupOf(string(name), 1, string(token)))
+			if b.Get(tokenLookup) != nil {
+				return nil
+			}
+			return b.Put(tokenLookup, lookup)
+		})
+	})
+}
+
+func (v *tokenVault) domain(name string) *vaultDomain {
+	return &vaultDomain{vault: v, name: name}
+}
+
+// lookup is the key an input is stored under
+func (d *vaultDomain) lookup(input string) string {
+	return d.vault.lookupOf(d.name, 0, input)
+}
+
+// tokenLookup is the key the owner of a token is stored under
+func (d *vaultDomain) tokenLookup(token string) string {
+	return d.vault.lookupOf(d.name, 1, token)
+}
+
+// lookupOf hashes an input (kind 0) or token (kind 1) of a domain
+func (v *tokenVault) lookupOf(domain string, kind byte, value string) string {
+	mac := hmac.New(sha256.New, v.lookupKey)
+	mac.Write([]byte(domain))
+	mac.Write([]byte{kind})
+	mac.Write([]byte(value))
+	return string(mac.Sum(nil))
+}
+
+// get returns the token stored for input
+func (d *vaultDomain) get(input string) (string, bool, error) {
+	v := d.vault
+	ref := vaultRef{domain: d.name, lookup: d.lookup(input)}
+
+	v.mu.Lock()
+	token, ok := v.pending[ref]
+	v.mu.Unlock()
+	if ok {
+		return token, true, nil
+	}
+
+	var sealed []byte
+	err := v.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(vaultDomainsBucket).Bucket([]byte(d.name)); b != nil {
+			if s := b.Get([]byte(ref.lookup)); s != nil {
+				sealed = append([]byte(nil), s...)
+			}
+		}
+		return nil
+	})
+	if err != nil || sealed == nil {
+		return "", false, err
+	}
+
+	plain, err := v.open(sealed, tokenAAD(d.name, []byte(ref.lookup)))
+	if err != nil {
+		return "", false, fmt.Errorf("vault %s: token in domain '%s' can't be decrypted: %w", v.path, d.name, err)
+	}
+	return string(plain), true, nil
+}
+
+// put records a new token for input; it is written with the next batch
+func (d *vaultDomain) put(input, token string) error {
+	v := d.vault
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	lookup := d.lookup(input)
+	v.pending[vaultRef{domain: d.name, lookup: lookup}] = token
+	v.pendingOwners[vaultRef{domain: d.name, lookup: d.tokenLookup(token)}] = lookup
+	if len(v.pending) < vaultBatchSize {
+		return nil
+	}
+	return v.flushLocked()
+}
+
+// takenByOther reports whether token belongs to an input other than input
+func (d *vaultDomain) takenByOther(token, input string) (bool, error) {
+	v := d.vault
+	ref := vaultRef{domain: d.name, lookup: d.tokenLookup(token)}
+
+	v.mu.Lock()
+	owner, ok := v.pendingOwners[ref]
+	v.mu.Unlock()
+
+	if !ok {
+		err := v.db.View(func(tx *bolt.Tx) error {
+			if b := tx.Bucket(vaultOwnersBucket).Bucket([]byte(d.name)); b != nil {
+				if o := b.Get([]byte(ref.lookup)); o != nil {
+					owner, ok = string(o), true
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return false, err
+		}
+	}
+	return ok && owner != d.lookup(input), nil
+}
+
+// Flush writes the pending tokens; a nil vault is a no-op
+func (v *tokenVault) Flush() error {
+	if v == nil {
+		return nil
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.flushLocked()
+}
+
+func (v *tokenVault) flushLocked() error {
+	if len(v.pending) == 0 {
+		return nil
+	}
+
+	err := v.db.Update(func(tx *bolt.Tx) error {
+		err := putSorted(tx.Bucket(vaultDomainsBucket), v.pending, func(ref vaultRef, token string) ([]byte, error) {
+			return v.seal([]byte(token), tokenAAD(ref.domain, []byte(ref.lookup)))
+		})
+		if err != nil {
+			return err
+		}
+		return putSorted(tx.Bucket(vaultOwnersBucket), v.pendingOwners, func(_ vaultRef, owner string) ([]byte, error) {
+			return []byte(owner), nil
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write to vault %s: %w", v.path, err)
+	}
+
+	v.added += int64(len(v.pending))
+	v.pending = make(map[vaultRef]string)
+	v.pendingOwners = make(map[vaultRef]string)
+	return nil
+}
+
+// putSorted stores entries in the per-domain buckets below parent, in key
+// order: bbolt inserts sorted keys far faster than random ones
+func putSorted(parent *bolt.Bucket, entries map[vaultRef]string, encode func(vaultRef, string) ([]byte, error)) error {
+	refs := make([]vaultRef, 0, len(entries))
+	for ref := range entries {
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].domain != refs[j].domain {
+			return refs[i].domain < refs[j].domain
+		}
+		return refs[i].lookup < refs[j].lookup
+	})
+
+	var b *bolt.Bucket
+	for i, ref := range refs {
+		if i == 0 || ref.domain != refs[i-1].domain {
+			var err error
+			if b, err = parent.CreateBucketIfNotExists([]byte(ref.domain)); err != nil {
+				return err
+			}
+		}
+		value, err := encode(ref, entries[ref])
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte(ref.lookup), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close writes the pending tokens and closes the file; a nil vault is a no-op
+// and closing twice is safe
+func (v *tokenVault) Close() error {
+	if v == nil {
+		return nil
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.db == nil {
+		return nil
+	}
+	err := v.flushLocked()
+	if cerr := v.db.Close(); err == nil {
+		err = cerr
+	}
+	v.db = nil
+	return err
+}
+
+// summary reports the tokens added for the final log entry; nil without a
+// vault
+func (v *tokenVault) summary() map[string]interface{} {
+	if v == nil {
+		return nil
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return map[string]interface{}{"vault_tokens_added": v.added}
+}
+
+// useVault backs the substitution maskers in columns with vault, each in its
+// own domain, and returns the domains in use
+func useVault(columns []ColumnMasker, vault *tokenVault) []string {
+	seen := make(map[*MaskingService]bool)
+	var domains []string
+	for _, col := range columns {
+		ms, ok := col.Masker.(*MaskingService)
+		if !ok || seen[ms] {
+			continue
+		}
+		seen[ms] = true
+		ms.vault = vault.domain(ms.domain)
+		domains = append(domains, ms.domain)
+	}
+	return domains
+}
+
+// vaultRecord is a line of a vault export. The first line carries only
+// Check, the sealed check value, so an import can verify the key; every other
+// line is one token, still sealed.
+type vaultRecord struct {
+	Check  []byte `json:"check,omitempty"`
+	Domain string `json:"domain,omitempty"`
+	Lookup []byte `json:"lookup,omitempty"`
+	Token  []byte `json:"token,omitempty"`
+}
+
+// export writes the tokens of the given domains (all when empty) as JSON
+// Lines and returns how many it wrote
+func (v *tokenVault) export(w io.Writer, domains []string) (int64, error) {
+	if err := v.Flush(); err != nil {
+		return 0, err
+	}
+
+	wanted := make(map[string]bool)
+	for _, d := range domains {
+		wanted[d] = true
+	}
+
+	enc := json.NewEncoder(w)
+	var count int64
+	err := v.db.View(func(tx *bolt.Tx) error {
+		if err := enc.Encode(vaultRecord{Check: tx.Bucket(vaultMetaBucket).Get(vaultCheckKey)}); err != nil {
+			return err
+		}
+		return tx.Bucket(vaultDomainsBucket).ForEachBucket(func(name []byte) error {
+			if len(wanted) > 0 && !wanted[string(name)] {
+				return nil
+			}
+			return tx.Bucket(vaultDomainsBucket).Bucket(name).ForEach(func(k, s []byte) error {
+				count++
+				return enc.Encode(vaultRecord{Domain: string(name), Lookup: k, Token: s})
+			})
+		})
+	})
+	return count, err
+}
+
+// importResult counts what an import did with the records it read
+type importResult struct {
+	added, unchanged, conflicts int64
+}
+
+// importRecords adds the tokens of an export made with the same key. A token
+// that differs from the one already stored for the same input, or that
+// another input already has, is a conflict and is skipped, so pseudonyms
+// already handed out don't change.
+func (v *tokenVault) importRecords(r io.Reader) (importResult, error) {
+	var res importResult
+	if err := v.Flush(); err != nil {
+		return res, err
+	}
+	dec := json.NewDecoder(bufio.NewReader(r))
+
+	var header vaultRecord
+	if err := dec.Decode(&header); err != nil {
+		return res, fmt.Errorf("failed to read export header: %w", err)
+	}
+	if header.Check == nil {
+		return res, errors.New("export does not start with a check record")
+	}
+	if err := v.verifyCheck(header.Check); err != nil {
+		return res, errors.New("export was made with a different vault key")
+	}
+
+	var batch []vaultRecord
+	for line := 2; ; line++ {
+		var rec vaultRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return res, fmt.Errorf("failed to read export line %d: %w", line, err)
+		}
+		if rec.Domain == "" || len(rec.Lookup) == 0 {
+			return res, fmt.Errorf("export line %d has no domain or lookup key", line)
+		}
+		if _, err := v.open(rec.Token, tokenAAD(rec.Domain, rec.Lookup)); err != nil {
+			return res, fmt.Errorf("token in domain '%s' can't be decrypted: %w", rec.Domain, err)
+		}
+
+		batch = append(batch, rec)
+		if len(batch) == vaultBatchSize {
+			if err := v.importBatch(batch, &res); err != nil {
+				return res, err
+			}
+			batch = batch[:0]
+		}
+	}
+	return res, v.importBatch(batch, &res)
+}
+
+// importBatch stores batch in one transaction and adds its counts to res
+// once that is committed
+func (v *tokenVault) importBatch(batch []vaultRecord, res *importResult) error {
+	var counts importResult
+	err := v.db.Update(func(tx *bolt.Tx) error {
+		counts = importResult{} // a retried transaction starts over
+		for _, rec := range batch {
+			b, err := tx.Bucket(vaultDomainsBucket).CreateBucketIfNotExists([]byte(rec.Domain))
+			if err != nil {
+				return err
+			}
+			owners, err := tx.Bucket(vaultOwnersBucket).CreateBucketIfNotExists([]byte(rec.Domain))
+			if err != nil {
+				return err
+			}
+
+			aad := tokenAAD(rec.Domain, rec.Lookup)
+			imported, _ := v.open(rec.Token, aad) // checked when it was read
+
+			if existing := b.Get(rec.Lookup); existing != nil {
+				stored, err := v.open(existing, aad)
+				if err != nil {
+					return fmt.Errorf("token in domain '%s' can't be decrypted: %w", rec.Domain, err)
+				}
+				if bytes.Equal(stored, imported) {
+					counts.unchanged++
+				} else {
+					counts.conflicts++
+				}
+				continue
+			}
+
+			// A token another input already has would merge the two
+			tokenLookup := []byte(v.lookupOf(rec.Domain, 1, string(imported)))
+			if owner := owners.Get(tokenLookup); owner != nil && !bytes.Equal(owner, rec.Lookup) {
+				counts.conflicts++
+				continue
+			}
+
+			counts.added++
+			if err := b.Put(rec.Lookup, rec.Token); err != nil {
+				return err
+			}
+			if err := owners.Put(tokenLookup, rec.Lookup); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write to vault %s: %w", v.path, err)
+	}
+	res.added += counts.added
+	res.unchanged += counts.unchanged
+	res.conflicts += counts.conflicts
+	return nil
+}
+
+// vaultFlags are the flags shared by the vault-export and vault-import commands
+type vaultFlags struct {
+	path    *string
+	keyFile *string
+	quiet   *bool
+}
+
+func registerVaultFlags(fs *flag.FlagSet) *vaultFlags {
+	return &vaultFlags{
+		path:    fs.String("vault", "", "path to the token vault"),
+		keyFile: fs.String("vault_key_file", "", "path to a file containing the vault secret"),
+		quiet:   fs.Bool("quiet", false, "run in quiet mode (no console output)"),
+	}
+}
+
+func (vf *vaultFlags) open() (*tokenVault, error) {
+	if *vf.path == "" || *vf.keyFile == "" {
+		return nil, newStageError(stageConfig, errors.New("-vault and -vault_key_file are required"))
+	}
+	secret, err := loadVaultKey(*vf.keyFile)
+	if err != nil {
+		return nil, newStageError(stageConfig, err)
+	}
+	if err := initImprovedLogger(*vf.quiet, false, false); err != nil {
+		return nil, err
+	}
+	v, err := openVault(*vf.path, secret)
+	if err != nil {
+		logger.LogError("Opening vault", err)
+		return nil, newStageError(stageConfig, err)
+	}
+	return v, nil
+}
+
+// runVaultExport implements the "vault-export" command: it writes the tokens
+// of a vault, still encrypted, to a JSON Lines file that vault-import can
+// load into a vault with the same key elsewhere
+func runVaultExport(args []string) error {
+	fs := flag.NewFlagSet("vault-export", flag.ExitOnError)
+	vf := registerVaultFlags(fs)
+	outputPath := fs.String("output_path", "vault-export.jsonl", "path of the export file")
+	domainsStr := fs.String("domains", "", "comma-separated domains to export (default all)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	v, err := vf.open()
+	if err != nil {
+		return err
+	}
+	defer logger.Close()
+	defer v.Close()
+
+	var domains []string
+	if *domainsStr != "" {
+		for _, d := range strings.Split(*domainsStr, ",") {
+			domains = append(domains, strings.TrimSpace(d))
+		}
+	}
+
+	file, err := os.OpenFile(*outputPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return newStageError(stageOutput, err)
+	}
+	w := bufio.NewWriter(file)
+	count, err := v.export(w, domains)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		logger.LogError("Exporting vault", err)
+		os.Remove(*outputPath)
+		return newStageError(stageOutput, err)
+	}
+
+	logger.Info("Vault exported", map[string]interface{}{
+		"vault":       *vf.path,
+		"output_file": *outputPath,
+		"tokens":      count,
+	})
+	return nil
+}
+
+// runVaultImport implements the "vault-import" command: it merges a
+// vault-export file into a vault with the same key, creating it if needed
+func runVaultImport(args []string) error {
+	fs := flag.NewFlagSet("vault-import", flag.ExitOnError)
+	vf := registerVaultFlags(fs)
+	inputPath := fs.String("input_path", "vault-export.jsonl", "path of the export file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	file, err := os.Open(*inputPath)
+	if err != nil {
+		return newStageError(stageInput, err)
+	}
+	defer file.Close()
+
+	v, err := vf.open()
+	if err != nil {
+		return err
+	}
+	defer logger.Close()
+	defer v.Close()
+
+	res, err := v.importRecords(file)
+	if err != nil {
+		logger.LogError("Importing vault", err, map[string]interface{}{
+			"tokens_added": res.added,
+		})
+		return newStageError(stageInput, err)
+	}
+
+	fields := map[string]interface{}{
+		"vault":            *vf.path,
+		"input_file":       *inputPath,
+		"tokens_added":     res.added,
+		"tokens_unchanged": res.unchanged,
+		"token_conflicts":  res.conflicts,
+	}
+	if res.conflicts > 0 {
+		logger.Warn("Vault imported; conflicting tokens were skipped", fields)
+	} else {
+		logger.Info("Vault imported", fields)
+	}
+	return nil
+}
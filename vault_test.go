@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// vaultMasker returns a random masking service backed by domain of v
+func vaultMasker(v *tokenVault, domain string) *MaskingService {
+	ms := NewMaskingService()
+	ms.domain = domain
+	useVault([]ColumnMasker{{Masker: ms}}, v)
+	return ms
+}
+
+// maskAll masks inputs with ms and returns the substitutions
+func maskAll(t *testing.T, ms *MaskingService, inputs []string) []string {
+	t.Helper()
+	out := make([]string, len(inputs))
+	for i, input := range inputs {
+		masked, err := ms.Mask(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out[i] = masked
+	}
+	return out
+}
+
+func vaultInputs(n int) []string {
+	inputs := make([]string, n)
+	for i := range inputs {
+		inputs[i] = "customer-" + strconv.Itoa(i)
+	}
+	return inputs
+}
+
+// TestVaultAcrossRuns checks that a reopened vault gives inputs the tokens
+// of the earlier run, per domain
+func TestVaultAcrossRuns(t *testing.T) {
+	path, secret := testPath(t, "tokens.db"), []byte("vault secret")
+	inputs := vaultInputs(100)
+
+	v, err := openVault(path, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	customers := maskAll(t, vaultMasker(v, "customers"), inputs)
+	orders := maskAll(t, vaultMasker(v, "orders"), inputs)
+	if err := v.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err = openVault(path, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	if got := maskAll(t, vaultMasker(v, "customers"), inputs); strings.Join(got, ",") != strings.Join(customers, ",") {
+		t.Error("reopened vault gives customers new tokens")
+	}
+	if strings.Join(orders, ",") == strings.Join(customers, ",") {
+		t.Error("domains customers and orders share their tokens")
+	}
+}
+
+// TestVaultExportImport moves the tokens of one vault into another with the
+// same key and checks they are used there, and that importing again or over
+// different tokens changes nothing
+func TestVaultExportImport(t *testing.T) {
+	secret := []byte("vault secret")
+	inputs := vaultInputs(100)
+
+	src, err := openVault(testPath(t, "src.db"), secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	want := maskAll(t, vaultMasker(src, "customers"), inputs)
+	maskAll(t, vaultMasker(src, "orders"), inputs)
+
+	var export bytes.Buffer
+	if n, err := src.export(&export, []string{"customers"}); err != nil || n != int64(len(inputs)) {
+		t.Fatalf("export = %d, %v; want %d tokens", n, err, len(inputs))
+	}
+
+	dst, err := openVault(testPath(t, "dst.db"), secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	// An input masked before the import keeps its own token
+	kept := maskAll(t, vaultMasker(dst, "customers"), inputs[:1])
+
+	res, err := dst.importRecords(bytes.NewReader(export.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != (importResult{added: int64(len(inputs)) - 1, conflicts: 1}) {
+		t.Errorf("import = %+v, want %d added and 1 conflict", res, len(inputs)-1)
+	}
+	res, err = dst.importRecords(bytes.NewReader(export.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != (importResult{unchanged: int64(len(inputs)) - 1, conflicts: 1}) {
+		t.Errorf("second import = %+v, want %d unchanged and 1 conflict", res, len(inputs)-1)
+	}
+
+	got := maskAll(t, vaultMasker(dst, "customers"), inputs)
+	if got[0] != kept[0] {
+		t.Errorf("%s changed from %s to %s on import", inputs[0], kept[0], got[0])
+	}
+	if strings.Join(got[1:], ",") != strings.Join(want[1:], ",") {
+		t.Error("imported vault gives inputs other tokens than the exporting one")
+	}
+}
+
+// TestVaultWrongKey checks that a vault and its exports can't be used with
+// another key and that a tampered token is refused
+func TestVaultWrongKey(t *testing.T) {
+	path := testPath(t, "tokens.db")
+	v, err := openVault(path, []byte("vault secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	maskAll(t, vaultMasker(v, "customers"), vaultInputs(10))
+	var export bytes.Buffer
+	if _, err := v.export(&export, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := openVault(path, []byte("another secret")); err == nil || !strings.Contains(err.Error(), "key does not match") {
+		t.Errorf("opening with another key = %v, want a key mismatch", err)
+	}
+
+	other, err := openVault(testPath(t, "other.db"), []byte("another secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if _, err := other.importRecords(bytes.NewReader(export.Bytes())); err == nil || !strings.Contains(err.Error(), "different vault key") {
+		t.Errorf("importing into a vault with another key = %v, want a key mismatch", err)
+	}
+
+	// Flip a bit of the first token's ciphertext, after the header line
+	lines := bytes.SplitN(export.Bytes(), []byte("\n"), 3)
+	var rec vaultRecord
+	if err := json.Unmarshal(lines[1], &rec); err != nil {
+		t.Fatal(err)
+	}
+	rec.Token[len(rec.Token)-1] ^= 1
+	tampered, err := json.Marshal(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	same, err := openVault(testPath(t, "same.db"), []byte("vault secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer same.Close()
+	input := bytes.Join([][]byte{lines[0], tampered, lines[2]}, []byte("\n"))
+	if _, err := same.importRecords(bytes.NewReader(input)); err == nil || !strings.Contains(err.Error(), "can't be decrypted") {
+		t.Errorf("importing a tampered token = %v, want a decryption error", err)
+	}
+}
+
+// TestVaultOwnersMigration opens a vault without the owners of its tokens, as
+// made before unique masking, and checks unique masking avoids its tokens
+func TestVaultOwnersMigration(t *testing.T) {
+	path, secret := testPath(t, "tokens.db"), []byte("vault secret")
+	uniqueMasker := func(v *tokenVault) *MaskingService {
+		ms := vaultMasker(v, "digits")
+		ms.RequireUnique()
+		return ms
+	}
+
+	v, err := openVault(path, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var digits []string
+	for i := 0; i < 10; i++ {
+		digits = append(digits, strconv.Itoa(i))
+	}
+	old := maskAll(t, uniqueMasker(v), digits[:5])
+	if err := v.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := bolt.Open(path, 0o600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error { return tx.DeleteBucket(vaultOwnersBucket) }); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err = openVault(path, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	seen := make(map[string]bool)
+	for _, masked := range append(old, maskAll(t, uniqueMasker(v), digits[5:])...) {
+		if seen[masked] {
+			t.Fatalf("two digits masked to %s", masked)
+		}
+		seen[masked] = true
+	}
+}
+
+// TestSetupClosesVault fails a run after its vault is opened and checks the
+// vault isn't left locked
+func TestSetupClosesVault(t *testing.T) {
+	input, vaultPath, keyFile := testPath(t, "input.parquet"), testPath(t, "tokens.db"), testPath(t, "vault.key")
+	writeParquetFixture(t, input, new(readerRow), []interface{}{&readerRow{ID: 1, Name: "alice", City: "Oslo"}}, 0)
+	if err := os.WriteFile(keyFile, []byte("vault secret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The output directory goes away between parsing and setup, so opening
+	// the output fails after the vault
+	outputDir := t.TempDir()
+	config := parseArgs(t, "-input_path", input, "-output_path", filepath.Join(outputDir, "output.csv"),
+		"-columns", "name", "-vault", vaultPath, "-vault_key_file", keyFile, "-quiet")
+	if err := os.Remove(outputDir); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(t.TempDir())
+	if _, err := setupApplication(config); err == nil {
+		t.Fatal("setup succeeded without an output directory")
+	}
+	logger.Close()
+
+	v, err := openVault(vaultPath, []byte("vault secret"))
+	if err != nil {
+		t.Fatalf("vault of the failed setup: %v", err)
+	}
+	v.Close()
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+const closedJSONLWriterErrorMsg = "cannot write to closed JSON Lines writer"
+
+// JSONLWriter writes one JSON object per row, keyed by column path, with keys
+// in schema order. Nested parquet input keeps its structs, lists and maps, and
+// values keep the JSON type of their column.
+type JSONLWriter struct {
+	file     *os.File
+	writer   *bufio.Writer
+	fields   []*fieldNode
+	types    []valueType // by column
+	scratch  bytes.Buffer
+	encoder  *json.Encoder // encodes single values into scratch
+	filePath string
+	closed   bool
+}
+
+func NewJSONLWriter(writePath string, schema *Schema) (*JSONLWriter, error) {
+	fields := schema.Fields
+	if fields == nil {
+		var err error
+		if fields, err = flatFields(schema.Columns); err != nil {
+			return nil, err
+		}
+	}
+
+	writeFile, err := os.OpenFile(writePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file %s: %w", writePath, err)
+	}
+
+	types := make([]valueType, len(schema.Columns))
+	for i, col := range schema.Columns {
+		types[i] = col.Type
+	}
+
+	jw := &JSONLWriter{
+		file:     writeFile,
+		writer:   bufio.NewWriter(writeFile),
+		fields:   fields,
+		types:    types,
+		filePath: writePath,
+		closed:   false,
+	}
+	jw.encoder = json.NewEncoder(&jw.scratch)
+	jw.encoder.SetEscapeHTML(false) // keep values such as "<b>" readable
+	return jw, nil
+}
+
+// encodeValue writes v as JSON without the trailing newline added by Encoder
+func (jw *JSONLWriter) encodeValue(v interface{}) error {
+	jw.scratch.Reset()
+	if err := jw.encoder.Encode(v); err != nil {
+		return err
+	}
+	jw.writer.Write(bytes.TrimSuffix(jw.scratch.Bytes(), []byte("\n")))
+	return nil
+}
+
+// writeLeaf writes value as its column type, or as a string when it isn't a
+// value of that type
+func (jw *JSONLWriter) writeLeaf(value string, typ valueType) error {
+	var raw bool
+	switch typ {
+	case numberValue:
+		raw = value != "" && (value[0] == '-' || value[0] >= '0' && value[0] <= '9') && json.Valid([]byte(value))
+	case boolValue:
+		raw = value == "true" || value == "false"
+	case objectValue:
+		raw = value != "" && (value[0] == '{' || value[0] == '[') && json.Valid([]byte(value))
+	}
+	if raw {
+		_, err := jw.writer.WriteString(value)
+		return err
+	}
+	return jw.encodeValue(value)
+}
+
+// WriteColumnsNoFlush encodes the rows of columns into the buffer without
+// flushing; nulls are JSON null
+func (jw *JSONLWriter) WriteColumnsNoFlush(columns []*ColumnVector) error {
+	if jw.closed {
+		return errors.New(closedJSONLWriterErrorMsg)
+	}
+
+	if len(columns) != len(jw.types) {
+		return fmt.Errorf("batch has %d columns, schema has %d", len(columns), len(jw.types))
+	}
+
+	rows := Batch{Columns: columns}.Len()
+	for i := 0; i < rows; i++ {
+		if err := jw.writeStruct(jw.fields, columns, i, 0); err != nil {
+			return fmt.Errorf("failed to encode JSON row %d: %w", i, err)
+		}
+		if _, err := jw.writer.WriteString("\n"); err != nil {
+			return fmt.Errorf("failed to write JSON row %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// writeStruct writes fields as a JSON object; elem is the list element the
+// fields belong to, 0 outside lists
+func (jw *JSONLWriter) writeStruct(fields []*fieldNode, columns []*ColumnVector, row, elem int) error {
+	jw.writer.WriteByte('{')
+	for j, field := range fields {
+		if j > 0 {
+			jw.writer.WriteByte(',')
+		}
+		jw.writer.Write(field.key)
+		if err := jw.writeField(field, columns, row, elem); err != nil {
+			return err
+		}
+	}
+	jw.writer.WriteByte('}')
+	return nil
+}
+
+// writeField writes the value of field in row, or null when the field or a
+// parent of it is null there
+func (jw *JSONLWriter) writeField(field *fieldNode, columns []*ColumnVector, row, elem int) error {
+	col := columns[field.column]
+	slot, _ := col.slots(row, row+1)
+	slot += elem
+
+	if field.kind == leafField {
+		if col.IsNull(slot) {
+			jw.writer.WriteString("null")
+			return nil
+		}
+		return jw.writeLeaf(col.String(slot), jw.types[field.column])
+	}
+
+	if col.def(slot) < field.def {
+		jw.writer.WriteString("null")
+		return nil
+	}
+
+	switch field.kind {
+	case listField:
+		_, n := col.elements(row)
+		jw.writer.WriteByte('[')
+		for k := 0; k < n; k++ {
+			if k > 0 {
+				jw.writer.WriteByte(',')
+			}
+			if err := jw.writeField(field.children[0], columns, row, k); err != nil {
+				return err
+			}
+		}
+		jw.writer.WriteByte(']')
+
+	case mapField:
+		key, value := field.children[0], field.children[1]
+		_, n := col.elements(row)
+		jw.writer.WriteByte('{')
+		for k := 0; k < n; k++ {
+			if k > 0 {
+				jw.writer.WriteByte(',')
+			}
+			keySlot, _ := columns[key.column].slots(row, row+1)
+			if err := jw.encodeValue(columns[key.column].String(keySlot + k)); err != nil {
+				return err
+			}
+			jw.writer.WriteByte(':')
+			if err := jw.writeField(value, columns, row, k); err != nil {
+				return err
+			}
+		}
+		jw.writer.WriteByte('}')
+
+	default:
+		return jw.writeStruct(field.children, columns, row, elem)
+	}
+	return nil
+}
+
+// Flush manually flushes the writer without closing
+func (jw *JSONLWriter) Flush() error {
+	if jw.closed {
+		return fmt.Errorf("cannot flush closed JSON Lines writer")
+	}
+
+	if err := jw.writer.Flush(); err != nil {
+		return fmt.Errorf("failed to flush JSON Lines writer: %w", err)
+	}
+
+	return nil
+}
+
+func (jw *JSONLWriter) Close() error {
+	if jw.closed {
+		return nil // Already closed
+	}
+
+	jw.closed = true
+
+	var flushErr error
+	if err := jw.writer.Flush(); err != nil {
+		flushErr = fmt.Errorf("writer flush error: %w", err)
+	}
+
+	// Always attempt to close the file, even if flush failed
+	if err := jw.file.Close(); err != nil {
+		if flushErr != nil {
+			return fmt.Errorf("multiple errors - flush: %v, close: %w", flushErr, err)
+		}
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+
+	return flushErr
+}
+
+// DeleteOutputFile closes and removes the output file; the file is removed
+// even when closing it fails
+func (jw *JSONLWriter) DeleteOutputFile() error {
+	return errors.Join(jw.Close(), os.Remove(jw.filePath))
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+type typedRow struct {
+	Name   *string  `parquet:"name=name, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	Age    *int32   `parquet:"name=age, type=INT32, repetitiontype=OPTIONAL"`
+	Score  float64  `parquet:"name=score, type=DOUBLE"`
+	Active bool     `parquet:"name=active, type=BOOLEAN"`
+	Amount int64    `parquet:"name=amount, type=INT64, convertedtype=DECIMAL, scale=2, precision=18"`
+	Phone  *int64   `parquet:"name=phone, type=INT64, repetitiontype=OPTIONAL"`
+	Ratio  *float32 `parquet:"name=ratio, type=FLOAT, repetitiontype=OPTIONAL"`
+}
+
+func typedRows() []interface{} {
+	name, age, phone, ratio := "alice", int32(42), int64(5551234), float32(0.5)
+	return []interface{}{
+		&typedRow{Name: &name, Age: &age, Score: 1.25, Active: true, Amount: 12345, Phone: &phone, Ratio: &ratio},
+		&typedRow{Score: -3, Amount: -1},
+	}
+}
+
+// TestJSONLValueTypes checks that numbers and booleans are written as JSON
+// types, masked numbers included, and that nulls stay null by default
+func TestJSONLValueTypes(t *testing.T) {
+	input := testPath(t, "input.parquet")
+	writeParquetFixture(t, input, new(typedRow), typedRows(), 0)
+
+	out := runJob(t, parseArgs(t, "-input_path", input, "-output_path", testPath(t, "output.jsonl"),
+		"-output_format", "jsonl", "-columns", "name,phone", "-mask_key", "secret", "-quiet"))
+
+	lines := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2:\n%s", len(lines), out)
+	}
+
+	for _, want := range []string{`"age":42,`, `"score":1.25,`, `"active":true,`, `"amount":"123.45",`, `"ratio":0.5}`} {
+		if !strings.Contains(lines[0], want) {
+			t.Errorf("line 1 %s lacks %s", lines[0], want)
+		}
+	}
+	if strings.Contains(lines[0], `"name":"alice"`) || strings.Contains(lines[0], `"phone":"`) || strings.Contains(lines[0], `"phone":5551234`) {
+		t.Errorf("line 1 %s: want name masked and phone masked to a number", lines[0])
+	}
+
+	want := `{"name":null,"age":null,"score":-3,"active":false,"amount":"-0.01","phone":null,"ratio":null}`
+	if lines[1] != want {
+		t.Errorf("line 2 = %s, want %s", lines[1], want)
+	}
+}
+
+// TestJSONLKeepsInputTypes checks that JSON Lines input keeps the types it was
+// written with, and that a value no longer of its column's type is a string
+func TestJSONLKeepsInputTypes(t *testing.T) {
+	input := testPath(t, "input.jsonl")
+	data := `{"id":1,"name":"a","ok":true,"tags":["x"],"zip":"01234","mixed":1}
+{"id":2,"name":"b","ok":false,"tags":[],"zip":"98765","mixed":"two"}
+`
+	if err := os.WriteFile(input, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	policy := testPath(t, "policy.yaml")
+	if err := os.WriteFile(policy, []byte("columns:\n  - column: id\n    strategy: redact\n    replacement: \"#\"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	out := runJob(t, parseArgs(t, "-input_path", input, "-output_path", testPath(t, "output.jsonl"),
+		"-output_format", "jsonl", "-policy", policy, "-quiet"))
+
+	want := `{"id":"#","name":"a","ok":true,"tags":["x"],"zip":"01234","mixed":"1"}
+{"id":"#","name":"b","ok":false,"tags":[],"zip":"98765","mixed":"two"}
+`
+	if string(out) != want {
+		t.Errorf("output\n%s\nwant\n%s", out, want)
+	}
+}
+
+// TestCSVNulls checks that nulls in masked columns stay null by default and
+// are written as the default null token, apart from empty strings, and that
+// CSV input reads the token back as null
+func TestCSVNulls(t *testing.T) {
+	input := testPath(t, "input.parquet")
+	empty := ""
+	writeParquetFixture(t, input, new(typedRow), append(typedRows(), &typedRow{Name: &empty}), 0)
+
+	out := runJob(t, parseArgs(t, "-input_path", input, "-output_path", testPath(t, "output.csv"),
+		"-columns", "name", "-mask_key", "secret", "-quiet"))
+	lines := strings.Split(string(out), "\n")
+	if !strings.HasPrefix(lines[2], `\N,\N,-3,`) {
+		t.Errorf("row 2 = %s, want the null name and age written as \\N", lines[2])
+	}
+	if strings.HasPrefix(lines[3], `\N,`) {
+		t.Errorf("row 3 = %s, want the empty name masked rather than null", lines[3])
+	}
+
+	// Masking that output again keeps its nulls
+	csvInput := testPath(t, "input.csv")
+	if err := os.WriteFile(csvInput, out, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	again := runJob(t, parseArgs(t, "-input_path", csvInput, "-output_path", testPath(t, "output.csv"),
+		"-columns", "name,age", "-mask_key", "secret", "-quiet"))
+	if lines := strings.Split(string(again), "\n"); !strings.HasPrefix(lines[2], `\N,\N,-3,`) {
+		t.Errorf("row 2 masked again = %s, want the null name and age kept as \\N", lines[2])
+	}
+
+	// With -keep_nulls=false nulls are masked like empty strings
+	out = runJob(t, parseArgs(t, "-input_path", input, "-output_path", testPath(t, "output.csv"),
+		"-columns", "name", "-mask_key", "secret", "-keep_nulls=false", "-csv_null", "", "-quiet"))
+	lines = strings.Split(string(out), "\n")
+	if masked, empty := strings.Split(lines[2], ",")[0], strings.Split(lines[3], ",")[0]; masked != empty {
+		t.Errorf("with -keep_nulls=false a null masked to %q and an empty string to %q", masked, empty)
+	}
+}
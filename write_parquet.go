@@ -5,6 +5,16 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/common"
+	"github.com/xitongsys/parquet-go/layout"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/schema"
+	"github.com/xitongsys/parquet-go/source"
+	"github.com/xitongsys/parquet-go/writer"
 )
 
 const (
@@ -13,10 +23,11 @@ const (
 )
 
 type CSVWriter struct {
-	file     *os.File
-	writer   *csv.Writer
-	filePath string
-	closed   bool
+	file      *os.File
+	writer    *csv.Writer
+	filePath  string
+	nullToken string // written for null values (-csv_null)
+	closed    bool
 }
 
 func NewCSVWriter(writePath string) (*CSVWriter, error) {
@@ -101,6 +112,31 @@ func (cw *CSVWriter) WriteRowsNoFlush(rows [][]string) error {
 	return nil
 }
 
+// WriteColumnsNoFlush writes the rows of columns without flushing, with
+// nullToken in place of nulls and lists as JSON arrays
+func (cw *CSVWriter) WriteColumnsNoFlush(columns []*ColumnVector) error {
+	if cw.closed {
+		return errors.New(closedWriterErrorMsg)
+	}
+
+	row := make([]string, len(columns))
+	rows := Batch{Columns: columns}.Len()
+	for i := 0; i < rows; i++ {
+		for j, col := range columns {
+			if text, null := col.Cell(i); null {
+				row[j] = cw.nullToken
+			} else {
+				row[j] = text
+			}
+		}
+		if err := cw.writer.Write(row); err != nil {
+			return fmt.Errorf("failed to write CSV row %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
 // Flush manually flushes the writer without closing
 func (cw *CSVWriter) Flush() error {
 	if cw.closed {
@@ -139,11 +175,348 @@ func (cw *CSVWriter) Close() error {
 	return flushErr
 }
 
+// DeleteOutputFile closes and removes the output file; the file is removed
+// even when closing it fails
 func (cw *CSVWriter) DeleteOutputFile() error {
-	err := cw.Close()
+	return errors.Join(cw.Close(), os.Remove(cw.filePath))
+}
+
+// supportedParquetCodecs are the codecs parquet-go can write
+var supportedParquetCodecs = map[parquet.CompressionCodec]bool{
+	parquet.CompressionCodec_UNCOMPRESSED: true,
+	parquet.CompressionCodec_SNAPPY:       true,
+	parquet.CompressionCodec_GZIP:         true,
+	parquet.CompressionCodec_LZ4:          true,
+	parquet.CompressionCodec_ZSTD:         true,
+}
+
+const defaultRowGroupSize = 128 * 1024 * 1024
+
+// ParquetWriter writes masked rows as parquet using the schema of the source
+// file, so column types, logical types, nullability and nesting survive
+// masking
+type ParquetWriter struct {
+	file     source.ParquetFile
+	writer   *writer.ParquetWriter
+	leaves   []*parquet.SchemaElement // leaf fields in column order
+	formats  []*logicalFormat         // per leaf, to parse rendered logical values
+	filePath string
+	closed   bool
+}
+
+// nestedCell is one row of a nested column: its values with their levels,
+// written as they are
+type nestedCell struct {
+	values []interface{}
+	defs   []int32
+	reps   []int32
+}
+
+// NewParquetWriter creates writePath with the schema, row-group size and
+// codec of the source file metadata. codec overrides the source codec when
+// non-empty (e.g. "zstd").
+func NewParquetWriter(writePath string, footer *parquet.FileMetaData, codec string) (*ParquetWriter, error) {
+	compression, err := parquetCodec(footer, codec)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	fw, err := local.NewLocalFileWriter(writePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file %s: %w", writePath, err)
+	}
+
+	pw, err := writer.NewParquetWriter(fw, footer.Schema, 4)
+	if err != nil {
+		fw.Close()
+		return nil, fmt.Errorf("failed to create parquet writer: %w", err)
+	}
+
+	// Rows arrive as one value or nestedCell per leaf column
+	pw.MarshalFunc = marshalColumns
+	pw.CompressionType = compression
+	pw.RowGroupSize = sourceRowGroupSize(footer)
+
+	sh := pw.SchemaHandler
+	leaves := make([]*parquet.SchemaElement, len(sh.ValueColumns))
+	formats := make([]*logicalFormat, len(sh.ValueColumns))
+	for i, path := range sh.ValueColumns {
+		leaves[i] = sh.SchemaElements[sh.MapIndex[path]]
+		formats[i] = newLogicalFormat(leaves[i], nil)
+	}
+
+	return &ParquetWriter{
+		file:     fw,
+		writer:   pw,
+		leaves:   leaves,
+		formats:  formats,
+		filePath: writePath,
+		closed:   false,
+	}, nil
+}
+
+// marshalColumns turns rows of leaf values into column tables. Top-level
+// values get their levels from nullability; nested cells carry their own.
+func marshalColumns(records []interface{}, sh *schema.SchemaHandler) (*map[string]*layout.Table, error) {
+	res := make(map[string]*layout.Table)
+	if len(records) == 0 {
+		return &res, nil
+	}
+
+	for i, path := range sh.ValueColumns {
+		index := sh.MapIndex[path]
+		table := layout.NewEmptyTable()
+		table.Path = common.StrToPath(path)
+		table.Schema = sh.SchemaElements[index]
+		table.Info = sh.Infos[index]
+		table.RepetitionType = table.Schema.GetRepetitionType()
+		table.MaxDefinitionLevel, _ = sh.MaxDefinitionLevel(table.Path)
+		table.MaxRepetitionLevel, _ = sh.MaxRepetitionLevel(table.Path)
+
+		table.Values = make([]interface{}, 0, len(records))
+		table.DefinitionLevels = make([]int32, 0, len(records))
+		table.RepetitionLevels = make([]int32, 0, len(records))
+
+		for _, rec := range records {
+			switch v := rec.([]interface{})[i].(type) {
+			case nestedCell:
+				table.Values = append(table.Values, v.values...)
+				table.DefinitionLevels = append(table.DefinitionLevels, v.defs...)
+				table.RepetitionLevels = append(table.RepetitionLevels, v.reps...)
+			default:
+				def := table.MaxDefinitionLevel
+				if v == nil {
+					def = 0
+				}
+				table.Values = append(table.Values, v)
+				table.DefinitionLevels = append(table.DefinitionLevels, def)
+				table.RepetitionLevels = append(table.RepetitionLevels, 0)
+			}
+		}
+		res[path] = table
+	}
+	return &res, nil
+}
+
+// stringParquetSchema describes columns without a parquet source (CSV or JSON
+// Lines input) as optional UTF8 strings
+func stringParquetSchema(columns []ColumnInfo) *parquet.FileMetaData {
+	numChildren := int32(len(columns))
+	elements := []*parquet.SchemaElement{{
+		Name:        "schema",
+		NumChildren: &numChildren,
+	}}
+
+	for _, col := range columns {
+		elements = append(elements, &parquet.SchemaElement{
+			Name:           col.Path,
+			Type:           parquet.TypePtr(parquet.Type_BYTE_ARRAY),
+			ConvertedType:  parquet.ConvertedTypePtr(parquet.ConvertedType_UTF8),
+			RepetitionType: parquet.FieldRepetitionTypePtr(parquet.FieldRepetitionType_OPTIONAL),
+			LogicalType:    &parquet.LogicalType{STRING: parquet.NewStringType()},
+		})
+	}
+
+	return &parquet.FileMetaData{Schema: elements}
+}
+
+// parquetCodec picks the override codec if given, otherwise the codec of the
+// source's first column chunk, falling back to snappy if it can't be written
+func parquetCodec(footer *parquet.FileMetaData, override string) (parquet.CompressionCodec, error) {
+	if override != "" {
+		codec, err := parquet.CompressionCodecFromString(strings.ToUpper(override))
+		if err != nil || !supportedParquetCodecs[codec] {
+			return 0, fmt.Errorf("unsupported parquet codec '%s' (expected uncompressed, snappy, gzip, lz4 or zstd)", override)
+		}
+		return codec, nil
+	}
+
+	for _, rg := range footer.RowGroups {
+		for _, col := range rg.Columns {
+			if col.MetaData != nil && supportedParquetCodecs[col.MetaData.Codec] {
+				return col.MetaData.Codec, nil
+			}
+		}
 	}
+	return parquet.CompressionCodec_SNAPPY, nil
+}
+
+// sourceRowGroupSize uses the largest source row group (uncompressed bytes) as
+// the target, so the output has about as many row groups as the input
+func sourceRowGroupSize(footer *parquet.FileMetaData) int64 {
+	var size int64
+	for _, rg := range footer.RowGroups {
+		if rg.TotalByteSize > size {
+			size = rg.TotalByteSize
+		}
+	}
+	if size <= 0 {
+		return defaultRowGroupSize
+	}
+	return size
+}
+
+// toParquetValue converts a rendered cell back to the physical type of el,
+// reading logical types in the form format renders them
+func toParquetValue(value string, el *parquet.SchemaElement, format *logicalFormat) (interface{}, error) {
+	if format != nil {
+		return format.parse(value)
+	}
+
+	switch el.GetType() {
+	case parquet.Type_BOOLEAN:
+		return strconv.ParseBool(value)
+	case parquet.Type_INT32:
+		v, err := strconv.ParseInt(value, 10, 32)
+		return int32(v), err
+	case parquet.Type_INT64:
+		return strconv.ParseInt(value, 10, 64)
+	case parquet.Type_FLOAT:
+		v, err := strconv.ParseFloat(value, 32)
+		return float32(v), err
+	case parquet.Type_DOUBLE:
+		return strconv.ParseFloat(value, 64)
+	default: // BYTE_ARRAY, FIXED_LEN_BYTE_ARRAY, INT96
+		return value, nil
+	}
+}
+
+// parquetNull is the value written for a null in el: nil for optional
+// fields, an empty string for required strings (e.g. the null strategy on a
+// required column). Other required fields can't hold it.
+func parquetNull(el *parquet.SchemaElement) (interface{}, error) {
+	if el.GetRepetitionType() == parquet.FieldRepetitionType_OPTIONAL {
+		return nil, nil
+	}
+	if el.GetType() == parquet.Type_BYTE_ARRAY {
+		return "", nil
+	}
+	return nil, fmt.Errorf("column '%s' is required and its type %s has no empty value for a null", el.GetName(), el.GetType())
+}
+
+// WriteColumnsNoFlush buffers the rows of columns. Columns read from parquet
+// are written as they are; text columns (masked values, text input) are
+// converted to the physical type of their field. Nested columns keep their
+// levels, except that a value masked to null becomes null at its own level.
+func (pw *ParquetWriter) WriteColumnsNoFlush(columns []*ColumnVector) error {
+	if pw.closed {
+		return errors.New("cannot write to closed parquet writer")
+	}
+
+	if len(columns) != len(pw.leaves) {
+		return fmt.Errorf("batch has %d columns, schema has %d", len(columns), len(pw.leaves))
+	}
+
+	rows := Batch{Columns: columns}.Len()
+	for i := 0; i < rows; i++ {
+		rec := make([]interface{}, len(columns))
+		for j, col := range columns {
+			var err error
+			if col.Levels != nil {
+				rec[j], err = pw.nestedCell(col, j, i)
+			} else {
+				rec[j], err = pw.value(col, j, i)
+			}
+			if err != nil {
+				return fmt.Errorf("row %d: %w", i, err)
+			}
+		}
+
+		if err := pw.writer.Write(rec); err != nil {
+			return fmt.Errorf("failed to write parquet row %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// value converts value i of col to the physical type of leaf j
+func (pw *ParquetWriter) value(col *ColumnVector, j, i int) (interface{}, error) {
+	el := pw.leaves[j]
+	if col.IsNull(i) {
+		return parquetNull(el)
+	}
+
+	// Typed values, including byte arrays with a logical type, are already
+	// in their physical form
+	if col.Kind != stringVector || col.Format != nil {
+		return col.Value(i), nil
+	}
+
+	v, err := toParquetValue(col.Strings[i], el, pw.formats[j])
+	if err != nil {
+		return nil, fmt.Errorf("value for column '%s' does not fit type %s: %w", el.GetName(), el.GetType(), err)
+	}
+	return v, nil
+}
+
+// nestedCell collects the slots of row in col, a nested column for leaf j
+func (pw *ParquetWriter) nestedCell(col *ColumnVector, j, row int) (nestedCell, error) {
+	start, end := col.slots(row, row+1)
+	levels := col.Levels
+	cell := nestedCell{
+		values: make([]interface{}, end-start),
+		defs:   levels.Defs[start:end],
+		reps:   levels.Reps[start:end],
+	}
+
+	copied := false // defs still shares the column's levels
+	for k := range cell.values {
+		if cell.defs[k] < levels.MaxDef {
+			continue // null or empty further up the path
+		}
+
+		v, err := pw.value(col, j, start+k)
+		if err != nil {
+			return nestedCell{}, err
+		}
+		if v == nil {
+			// Masked to null: the leaf is optional, so null it at its own level
+			if !copied {
+				cell.defs, copied = append([]int32(nil), cell.defs...), true
+			}
+			cell.defs[k] = levels.MaxDef - 1
+		}
+		cell.values[k] = v
+	}
+	return cell, nil
+}
+
+// Flush is a no-op: flushing on every call would produce tiny row groups.
+// Buffered rows are written by parquet-go as row groups fill and on Close.
+func (pw *ParquetWriter) Flush() error {
+	if pw.closed {
+		return fmt.Errorf("cannot flush closed parquet writer")
+	}
+	return nil
+}
+
+// Close writes the remaining rows and the footer
+func (pw *ParquetWriter) Close() error {
+	if pw.closed {
+		return nil // Already closed
+	}
+
+	pw.closed = true
+
+	var stopErr error
+	if err := pw.writer.WriteStop(); err != nil {
+		stopErr = fmt.Errorf("failed to finish parquet file: %w", err)
+	}
+
+	// Always attempt to close the file, even if WriteStop failed
+	if err := pw.file.Close(); err != nil {
+		if stopErr != nil {
+			return fmt.Errorf("multiple errors - write stop: %v, close: %w", stopErr, err)
+		}
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+
+	return stopErr
+}
 
-	return os.Remove(cw.filePath)
+// DeleteOutputFile closes and removes the output file; the file is removed
+// even when closing it fails
+func (pw *ParquetWriter) DeleteOutputFile() error {
+	return errors.Join(pw.Close(), os.Remove(pw.filePath))
 }